@@ -0,0 +1,133 @@
+package waiter
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bridge pumps packets between two NICs in both directions
+type Bridge struct {
+	A, B NIC
+	// FilterAB is called for packets read from A before writing them to B,
+	// return false to drop the packet. FilterBA is the opposite direction
+	FilterAB, FilterBA func(p *Packet) bool
+	// BatchSize max packets moved per read, default 64
+	BatchSize int
+
+	ab, ba bridgeCounters
+}
+
+// BridgeStats counters of one bridge direction
+type BridgeStats struct {
+	Packets, Bytes, Dropped, Errors uint64
+}
+
+type bridgeCounters struct {
+	packets, bytes, dropped, errors atomic.Uint64
+}
+
+func (c *bridgeCounters) stats() BridgeStats {
+	return BridgeStats{
+		Packets: c.packets.Load(),
+		Bytes:   c.bytes.Load(),
+		Dropped: c.dropped.Load(),
+		Errors:  c.errors.Load(),
+	}
+}
+
+// Stats get the counters of both directions
+func (b *Bridge) Stats() (ab, ba BridgeStats) {
+	return b.ab.stats(), b.ba.stats()
+}
+
+// Run pump packets until ctx is done or either side stops. it returns nil when
+// ctx is done, otherwise the error which stopped the bridge. both NICs must
+// implement ContextNIC: the reads are interrupted with a read deadline, the
+// previous deadline of a DeadlineNIC is restored afterwards. the NICs are not
+// closed
+func (b *Bridge) Run(ctx context.Context) error {
+	nics := []NIC{b.A, b.B}
+	var deadlines [2]time.Time
+	for i, n := range nics {
+		deadlines[i] = ReadDeadline(n)
+		if err := SetReadDeadline(n, deadlines[i]); err != nil {
+			return fmt.Errorf("bridge %T: %w", n, err)
+		}
+	}
+
+	pumpCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cancel(b.pump(pumpCtx, b.A, b.B, b.FilterAB, &b.ab))
+	}()
+	go func() {
+		defer wg.Done()
+		cancel(b.pump(pumpCtx, b.B, b.A, b.FilterBA, &b.ba))
+	}()
+
+	<-pumpCtx.Done()
+	for _, n := range nics {
+		SetReadDeadline(n, time.Now())
+	}
+	wg.Wait()
+	for i, n := range nics {
+		SetReadDeadline(n, deadlines[i])
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return context.Cause(pumpCtx)
+}
+
+func (b *Bridge) pump(ctx context.Context, src, dst NIC, filter func(*Packet) bool, counters *bridgeCounters) error {
+	size := cmp.Or(b.BatchSize, 64)
+	pkts := make([]*Packet, size)
+	out := make([]*Packet, 0, size)
+	for {
+		n, err := ReadBatch(src, pkts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		out = out[:0]
+		for _, p := range pkts[:n] {
+			if filter != nil && !filter(p) {
+				counters.dropped.Add(1)
+				p.Release()
+				continue
+			}
+			out = append(out, p)
+		}
+		clear(pkts[:n])
+		if len(out) == 0 {
+			continue
+		}
+		written, err := WriteBatch(dst, out)
+		for i, p := range out {
+			if i < written {
+				counters.packets.Add(1)
+				counters.bytes.Add(uint64(len(p.AsBytes())))
+			}
+			p.Release()
+		}
+		if err != nil {
+			counters.errors.Add(1)
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrClosed) {
+				return err
+			}
+		}
+	}
+}
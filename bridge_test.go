@@ -0,0 +1,146 @@
+package waiter_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+// bridged a bridge between the inner ends of two pipes, packets written to
+// a come out of b and the other way round
+func bridged(t *testing.T, br *nic.Bridge) (a, b *pipe.PipeNIC, done chan error, cancel context.CancelFunc) {
+	t.Helper()
+	a, innerA := pipe.New(pipe.Config{MTU: 1500})
+	innerB, b := pipe.New(pipe.Config{MTU: 1500})
+	t.Cleanup(func() {
+		for _, n := range []nic.NIC{a, innerA, innerB, b} {
+			n.Close()
+		}
+	})
+	br.A, br.B = innerA, innerB
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan error, 1)
+	go func() { done <- br.Run(ctx) }()
+	t.Cleanup(cancel)
+	return a, b, done, cancel
+}
+
+func readString(t *testing.T, n *pipe.PipeNIC) string {
+	t.Helper()
+	n.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := n.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+	return string(p.AsBytes())
+}
+
+func TestBridgeFilters(t *testing.T) {
+	br := &nic.Bridge{
+		FilterAB: func(p *nic.Packet) bool { return p.AsBytes()[0] != 'x' },
+		FilterBA: func(p *nic.Packet) bool { return p.AsBytes()[0] != 'y' },
+	}
+	a, b, done, cancel := bridged(t, br)
+	pool := nic.NewPacketPool(1500)
+	for _, w := range []struct {
+		n    *pipe.PipeNIC
+		data string
+	}{{a, "x-dropped"}, {a, "ab"}, {b, "y-dropped"}, {b, "ba-1"}, {b, "ba-2"}} {
+		p := newPacket(pool, w.data)
+		if err := w.n.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+	if got := readString(t, b); got != "ab" {
+		t.Fatalf("b read %q", got)
+	}
+	for _, want := range []string{"ba-1", "ba-2"} {
+		if got := readString(t, a); got != want {
+			t.Fatalf("a read %q, want %q", got, want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	ab, ba := br.Stats()
+	if want := (nic.BridgeStats{Packets: 1, Bytes: 2, Dropped: 1}); ab != want {
+		t.Fatalf("a to b %+v, want %+v", ab, want)
+	}
+	if want := (nic.BridgeStats{Packets: 2, Bytes: 8, Dropped: 1}); ba != want {
+		t.Fatalf("b to a %+v, want %+v", ba, want)
+	}
+	waitOutstanding(t, pool)
+}
+
+func TestBridgeSideClosed(t *testing.T) {
+	for _, side := range []string{"read", "write"} {
+		br := &nic.Bridge{}
+		a, b, done, _ := bridged(t, br)
+		if side == "read" {
+			// the inner end of a reads nothing more
+			a.Close()
+		} else {
+			// the inner end of b fails to write
+			b.Close()
+			p := nic.IPPacketPool.Get()
+			p.Write([]byte("lost"))
+			a.Write(p)
+			p.Release()
+		}
+		select {
+		case err := <-done:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("%s side closed: %v", side, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s side closed: bridge still running", side)
+		}
+		if _, ba := br.Stats(); side == "write" && ba.Errors != 0 {
+			t.Fatalf("b to a errors %d", ba.Errors)
+		}
+		if ab, _ := br.Stats(); side == "write" && ab.Errors != 1 {
+			t.Fatalf("a to b errors %d, want 1", ab.Errors)
+		}
+	}
+}
+
+func TestBridgeDeadline(t *testing.T) {
+	a, innerA := pipe.New(pipe.Config{MTU: 1500})
+	innerB, b := pipe.New(pipe.Config{MTU: 1500})
+	defer func() {
+		for _, n := range []nic.NIC{a, innerA, innerB, b} {
+			n.Close()
+		}
+	}()
+	deadline := time.Now().Add(time.Hour)
+	innerA.SetReadDeadline(deadline)
+
+	br := &nic.Bridge{A: innerA, B: innerB}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := br.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the deadlines set to stop the pumps are undone
+	if got := innerA.ReadDeadline(); !got.Equal(deadline) {
+		t.Fatalf("a deadline %v, want %v", got, deadline)
+	}
+	if got := innerB.ReadDeadline(); !got.IsZero() {
+		t.Fatalf("b deadline %v, want none", got)
+	}
+
+	// a nic without read deadlines cannot be bridged
+	br = &nic.Bridge{A: struct{ nic.NIC }{innerA}, B: innerB}
+	if err := br.Run(context.Background()); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("run without deadlines: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package waiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ContextNIC is implemented by NICs whose reads can be interrupted without
+// closing the NIC
+type ContextNIC interface {
+	NIC
+	// ReadContext read ip packet, it returns ctx.Err() when ctx is done
+	ReadContext(ctx context.Context) (*Packet, error)
+	// SetReadDeadline set the deadline for future and pending reads, reads
+	// after the deadline return os.ErrDeadlineExceeded. zero t means no deadline
+	SetReadDeadline(t time.Time) error
+}
+
+// DeadlineNIC is implemented by ContextNICs reporting their read deadline
+type DeadlineNIC interface {
+	ContextNIC
+	// ReadDeadline get the deadline set by SetReadDeadline
+	ReadDeadline() time.Time
+}
+
+// ReadContext read ip packet from n. a NIC not implementing ContextNIC can only
+// be read with a context which is never done
+func ReadContext(ctx context.Context, n NIC) (*Packet, error) {
+	if cn, ok := n.(ContextNIC); ok {
+		return cn.ReadContext(ctx)
+	}
+	if ctx.Done() != nil {
+		return nil, errors.ErrUnsupported
+	}
+	return n.Read()
+}
+
+// SetReadDeadline set the read deadline of n if it implements ContextNIC
+func SetReadDeadline(n NIC, t time.Time) error {
+	if cn, ok := n.(ContextNIC); ok {
+		return cn.SetReadDeadline(t)
+	}
+	return errors.ErrUnsupported
+}
+
+// ReadDeadline get the read deadline of n, zero if it does not implement
+// DeadlineNIC
+func ReadDeadline(n NIC) time.Time {
+	if dn, ok := n.(DeadlineNIC); ok {
+		return dn.ReadDeadline()
+	}
+	return time.Time{}
+}
+
+// Deadline is a resettable deadline to select on, the zero value has no deadline
+type Deadline struct {
+	mu     sync.Mutex
+	t      time.Time
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func (d *Deadline) init() {
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+}
+
+// Set the deadline, zero t means no deadline
+func (d *Deadline) Set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+	d.t = t
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// Time get the deadline, zero means no deadline
+func (d *Deadline) Time() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+// Done is closed when the deadline is exceeded
+func (d *Deadline) Done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
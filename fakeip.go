@@ -0,0 +1,333 @@
+package waiter
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFakeIPTTL = 24 * time.Hour
+	maxFakeIPs       = 1 << 20
+)
+
+var errFakeIPFamily = errors.New("fake ip pool has no prefix of this family")
+
+// ErrFakeIPExhausted every address of the prefix is mapped and unexpired
+var ErrFakeIPExhausted = errors.New("fake ip pool exhausted")
+
+// FakeIPPool hands out addresses of reserved prefixes to domain names, the
+// traffic sent to such an address can then be routed by its domain
+type FakeIPPool struct {
+	// IPv4, IPv6 the reserved prefixes, e.g. "198.18.0.0/15" and "fdfe:dcba:9876::/64".
+	// at most 2^20 addresses of a prefix are used
+	IPv4, IPv6 string
+	// TTL a mapping is kept after its last use, default 24h. the address of
+	// an unexpired mapping is never reused, when a prefix is exhausted
+	// Allocate fails with ErrFakeIPExhausted
+	TTL time.Duration
+	// Match select the domains given fake addresses, all domains when nil
+	Match func(domain string) bool
+
+	poolInit sync.Once
+	initErr  error
+	mu       sync.Mutex
+	v4, v6   *fakeIPRange
+}
+
+// FakeIPMapping a domain and its fake address
+type FakeIPMapping struct {
+	Domain  string
+	Addr    netip.Addr
+	Expires time.Time
+}
+
+type fakeIPRange struct {
+	prefix netip.Prefix
+	first  uint64 // offsets of the usable addresses
+	last   uint64
+	next   uint64
+	free   []netip.Addr
+	byName map[string]*list.Element
+	byAddr map[netip.Addr]*list.Element
+	lru    *list.List // of *FakeIPMapping, most recent first
+}
+
+func newFakeIPRange(s string, is4 bool) (*fakeIPRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, err
+	}
+	if prefix.Addr().Is4() != is4 {
+		return nil, fmt.Errorf("%s: wrong address family", s)
+	}
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits < 2 {
+		return nil, fmt.Errorf("%s: prefix too small", s)
+	}
+	size := uint64(maxFakeIPs)
+	if hostBits < 20 {
+		size = 1 << hostBits
+	}
+	r := &fakeIPRange{prefix: prefix, first: 1, last: size - 1}
+	if is4 && size == 1<<hostBits {
+		r.last-- // the broadcast address
+	}
+	r.reset()
+	return r, nil
+}
+
+func (r *fakeIPRange) reset() {
+	r.next = r.first
+	r.free = nil
+	r.byName = make(map[string]*list.Element)
+	r.byAddr = make(map[netip.Addr]*list.Element)
+	r.lru = list.New()
+}
+
+func (r *fakeIPRange) addr(i uint64) netip.Addr {
+	if r.prefix.Addr().Is4() {
+		b := r.prefix.Addr().As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(i))
+		return netip.AddrFrom4(b)
+	}
+	b := r.prefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+i)
+	return netip.AddrFrom16(b)
+}
+
+func (r *fakeIPRange) remove(e *list.Element) {
+	m := e.Value.(*FakeIPMapping)
+	r.lru.Remove(e)
+	delete(r.byName, m.Domain)
+	delete(r.byAddr, m.Addr)
+}
+
+// expire drop the expired mappings, the oldest ones are at the back
+func (r *fakeIPRange) expire(now time.Time) {
+	for e := r.lru.Back(); e != nil && !now.Before(e.Value.(*FakeIPMapping).Expires); e = r.lru.Back() {
+		r.free = append(r.free, e.Value.(*FakeIPMapping).Addr)
+		r.remove(e)
+	}
+}
+
+func (r *fakeIPRange) allocate(domain string, expires time.Time) (netip.Addr, error) {
+	if e, ok := r.byName[domain]; ok {
+		e.Value.(*FakeIPMapping).Expires = expires
+		r.lru.MoveToFront(e)
+		return e.Value.(*FakeIPMapping).Addr, nil
+	}
+	r.expire(time.Now())
+	var addr netip.Addr
+	switch {
+	case len(r.free) > 0:
+		addr = r.free[len(r.free)-1]
+		r.free = r.free[:len(r.free)-1]
+	case r.nextUnused():
+		addr = r.addr(r.next)
+		r.next++
+	default:
+		// the clients may still use every mapped address
+		return netip.Addr{}, ErrFakeIPExhausted
+	}
+	r.put(&FakeIPMapping{Domain: domain, Addr: addr, Expires: expires})
+	return addr, nil
+}
+
+// nextUnused move next past the addresses restored by Load, false when the
+// prefix is exhausted
+func (r *fakeIPRange) nextUnused() bool {
+	for ; r.next <= r.last; r.next++ {
+		if _, ok := r.byAddr[r.addr(r.next)]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *fakeIPRange) put(m *FakeIPMapping) {
+	e := r.lru.PushFront(m)
+	r.byName[m.Domain] = e
+	r.byAddr[m.Addr] = e
+}
+
+func (p *FakeIPPool) init() error {
+	p.poolInit.Do(func() {
+		var err4, err6 error
+		p.v4, err4 = newFakeIPRange(p.IPv4, true)
+		p.v6, err6 = newFakeIPRange(p.IPv6, false)
+		p.initErr = errors.Join(err4, err6)
+		if p.initErr == nil && p.v4 == nil && p.v6 == nil {
+			p.initErr = errors.New("no prefix")
+		}
+		if p.initErr != nil {
+			p.initErr = fmt.Errorf("fake ip pool: %w", p.initErr)
+		}
+	})
+	return p.initErr
+}
+
+func (p *FakeIPPool) ttl() time.Duration {
+	return cmp.Or(p.TTL, defaultFakeIPTTL)
+}
+
+func (p *FakeIPPool) rangeOf(addr netip.Addr) *fakeIPRange {
+	for _, r := range []*fakeIPRange{p.v4, p.v6} {
+		if r != nil && r.prefix.Contains(addr) {
+			return r
+		}
+	}
+	return nil
+}
+
+// normalizeDomain lowercase and without the trailing dot
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// Allocate the IPv4 or IPv6 fake address of domain, the mapping of a domain
+// is kept and refreshed. ErrFakeIPExhausted when no address is free
+func (p *FakeIPPool) Allocate(domain string, ipv6 bool) (netip.Addr, error) {
+	if err := p.init(); err != nil {
+		return netip.Addr{}, err
+	}
+	r := p.v4
+	if ipv6 {
+		r = p.v6
+	}
+	if r == nil {
+		return netip.Addr{}, errFakeIPFamily
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return r.allocate(normalizeDomain(domain), time.Now().Add(p.ttl()))
+}
+
+// Domain the domain of a fake address and refresh its mapping
+func (p *FakeIPPool) Domain(addr netip.Addr) (string, bool) {
+	if p.init() != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	r := p.rangeOf(addr)
+	if r == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := r.byAddr[addr]
+	if !ok {
+		return "", false
+	}
+	m := e.Value.(*FakeIPMapping)
+	now := time.Now()
+	if !now.Before(m.Expires) {
+		return "", false
+	}
+	m.Expires = now.Add(p.ttl())
+	r.lru.MoveToFront(e)
+	return m.Domain, true
+}
+
+// Contains whether addr is in the prefixes of the pool, mapped or not
+func (p *FakeIPPool) Contains(addr netip.Addr) bool {
+	return p.init() == nil && p.rangeOf(addr.Unmap()) != nil
+}
+
+// Mappings the unexpired mappings, most recently used first
+func (p *FakeIPPool) Mappings() []FakeIPMapping {
+	if p.init() != nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var mappings []FakeIPMapping
+	for _, r := range []*fakeIPRange{p.v4, p.v6} {
+		if r == nil {
+			continue
+		}
+		r.expire(now)
+		for e := r.lru.Front(); e != nil; e = e.Next() {
+			mappings = append(mappings, *e.Value.(*FakeIPMapping))
+		}
+	}
+	slices.SortStableFunc(mappings, func(a, b FakeIPMapping) int { return b.Expires.Compare(a.Expires) })
+	return mappings
+}
+
+// Save write the unexpired mappings as json, to be restored by Load after a
+// restart
+func (p *FakeIPPool) Save(w io.Writer) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(p.Mappings())
+}
+
+// Load replace the mappings with those written by Save. the expired ones and
+// those outside the prefixes are dropped
+func (p *FakeIPPool) Load(r io.Reader) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	var mappings []FakeIPMapping
+	if err := json.NewDecoder(r).Decode(&mappings); err != nil {
+		return fmt.Errorf("fake ip pool: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rg := range []*fakeIPRange{p.v4, p.v6} {
+		if rg != nil {
+			rg.reset()
+		}
+	}
+	// oldest first, so the most recent ones end at the front
+	slices.SortStableFunc(mappings, func(a, b FakeIPMapping) int { return a.Expires.Compare(b.Expires) })
+	now := time.Now()
+	for _, m := range mappings {
+		m.Domain, m.Addr = normalizeDomain(m.Domain), m.Addr.Unmap()
+		rg := p.rangeOf(m.Addr)
+		if rg == nil || m.Domain == "" || !now.Before(m.Expires) {
+			continue
+		}
+		if i := rg.offset(m.Addr); i < rg.first || i > rg.last {
+			continue
+		}
+		if e, ok := rg.byName[m.Domain]; ok {
+			rg.remove(e)
+		}
+		if e, ok := rg.byAddr[m.Addr]; ok {
+			rg.remove(e)
+		}
+		rg.put(&m)
+	}
+	return nil
+}
+
+// offset the offset of addr in the prefix, out of range when the upper 64
+// bits of an IPv6 address differ from the prefix
+func (r *fakeIPRange) offset(addr netip.Addr) uint64 {
+	if addr.Is4() {
+		a, b := addr.As4(), r.prefix.Addr().As4()
+		return uint64(binary.BigEndian.Uint32(a[:]) - binary.BigEndian.Uint32(b[:]))
+	}
+	a, b := addr.As16(), r.prefix.Addr().As16()
+	if [8]byte(a[:8]) != [8]byte(b[:8]) {
+		return r.last + 1
+	}
+	return binary.BigEndian.Uint64(a[8:]) - binary.BigEndian.Uint64(b[8:])
+}
@@ -0,0 +1,136 @@
+package waiter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+func TestFakeIPAllocate(t *testing.T) {
+	p := &nic.FakeIPPool{IPv4: "198.18.0.0/30", IPv6: "fdfe:dcba:9876::/64"}
+	a, err := p.Allocate("Example.COM.", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != netip.MustParseAddr("198.18.0.1") {
+		t.Fatalf("first address %s", a)
+	}
+	// the domain keeps its address, case and the trailing dot aside
+	if again, _ := p.Allocate("example.com", false); again != a {
+		t.Fatalf("second allocation %s, want %s", again, a)
+	}
+	if d, ok := p.Domain(a); !ok || d != "example.com" {
+		t.Fatalf("domain of %s: %q, %v", a, d, ok)
+	}
+	a6, err := p.Allocate("example.com", true)
+	if err != nil || !a6.Is6() || !p.Contains(a6) {
+		t.Fatalf("ipv6 address %s, %v", a6, err)
+	}
+	if !p.Contains(netip.MustParseAddr("::ffff:198.18.0.3")) || p.Contains(netip.MustParseAddr("198.18.0.4")) {
+		t.Fatal("contains the wrong addresses")
+	}
+	if _, ok := p.Domain(netip.MustParseAddr("198.18.0.2")); ok {
+		t.Fatal("unmapped address has a domain")
+	}
+
+	// a /30 has two usable addresses
+	if _, err := p.Allocate("b.example", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Allocate("c.example", false); !errors.Is(err, nic.ErrFakeIPExhausted) {
+		t.Fatalf("third allocation: %v", err)
+	}
+	if _, err := (&nic.FakeIPPool{IPv6: "fd00::/64"}).Allocate("a.example", false); err == nil {
+		t.Fatal("ipv4 address from an ipv6 pool")
+	}
+	for _, bad := range []*nic.FakeIPPool{{}, {IPv4: "fd00::/64"}, {IPv4: "198.18.0.0/31"}, {IPv6: "bogus"}} {
+		if _, err := bad.Allocate("a.example", false); err == nil {
+			t.Fatalf("allocated from %q %q", bad.IPv4, bad.IPv6)
+		}
+	}
+}
+
+func TestFakeIPExpiry(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	p := &nic.FakeIPPool{IPv4: "198.18.0.0/30", TTL: ttl}
+	a, _ := p.Allocate("a.example", false)
+	b, _ := p.Allocate("b.example", false)
+
+	// a use refreshes the mapping
+	time.Sleep(ttl * 3 / 5)
+	if _, ok := p.Domain(a); !ok {
+		t.Fatal("mapping expired early")
+	}
+	time.Sleep(ttl * 3 / 5)
+	if _, ok := p.Domain(a); !ok {
+		t.Fatal("used mapping expired")
+	}
+	if _, ok := p.Domain(b); ok {
+		t.Fatal("unused mapping kept")
+	}
+	if m := p.Mappings(); len(m) != 1 || m[0].Domain != "a.example" {
+		t.Fatalf("mappings %+v", m)
+	}
+
+	// the address of an expired mapping is reused
+	c, err := p.Allocate("c.example", false)
+	if err != nil || c != b {
+		t.Fatalf("allocated %s, %v, want %s", c, err, b)
+	}
+	if d, _ := p.Domain(b); d != "c.example" {
+		t.Fatalf("reused address maps to %q", d)
+	}
+}
+
+func TestFakeIPSaveLoad(t *testing.T) {
+	p := &nic.FakeIPPool{IPv4: "198.18.0.0/16", IPv6: "fdfe:dcba:9876::/64"}
+	a, _ := p.Allocate("a.example", false)
+	b, _ := p.Allocate("b.example", false)
+	a6, _ := p.Allocate("a.example", true)
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &nic.FakeIPPool{IPv4: "198.18.0.0/16", IPv6: "fdfe:dcba:9876::/64"}
+	if err := q.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[netip.Addr]string{a: "a.example", b: "b.example", a6: "a.example"} {
+		if d, ok := q.Domain(addr); !ok || d != want {
+			t.Fatalf("restored %s: %q, %v", addr, d, ok)
+		}
+	}
+	if got, _ := q.Allocate("b.example", false); got != b {
+		t.Fatalf("restored domain allocated %s, want %s", got, b)
+	}
+	// the new domains do not take the restored addresses
+	c, _ := q.Allocate("c.example", false)
+	if c == a || c == b {
+		t.Fatalf("new domain took %s", c)
+	}
+
+	// the expired mappings and those outside the prefixes are dropped
+	mappings, _ := json.Marshal([]nic.FakeIPMapping{
+		{Domain: "old.example", Addr: netip.MustParseAddr("198.18.0.9"), Expires: time.Now().Add(-time.Minute)},
+		{Domain: "out.example", Addr: netip.MustParseAddr("10.0.0.9"), Expires: time.Now().Add(time.Hour)},
+		{Domain: "New.Example.", Addr: netip.MustParseAddr("198.18.0.10"), Expires: time.Now().Add(time.Hour)},
+	})
+	if err := q.Load(bytes.NewReader(mappings)); err != nil {
+		t.Fatal(err)
+	}
+	if m := q.Mappings(); len(m) != 1 || m[0].Domain != "new.example" {
+		t.Fatalf("loaded %+v", m)
+	}
+	if _, ok := q.Domain(a); ok {
+		t.Fatal("load kept the previous mappings")
+	}
+	if err := q.Load(bytes.NewReader([]byte("{"))); err == nil {
+		t.Fatal("loaded garbage")
+	}
+}
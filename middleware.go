@@ -0,0 +1,309 @@
+package waiter
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction of a packet passing through a Chain
+type Direction uint8
+
+const (
+	// Inbound packets read from the NIC
+	Inbound Direction = iota + 1
+	// Outbound packets written to the NIC
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// Verdict of a Handler
+type Verdict uint8
+
+const (
+	// Pass the packet to the next handler
+	Pass Verdict = iota
+	// Drop the packet
+	Drop
+)
+
+// Handler handles packets passing through a Chain.
+//
+// The handler may modify p but never owns it: p must not be retained after
+// HandlePacket returns. To keep a packet (delay, reorder, mirror) take a
+// p.Clone() and send it later with the Injector.
+type Handler interface {
+	HandlePacket(dir Direction, p *Packet, inj Injector) Verdict
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(dir Direction, p *Packet, inj Injector) Verdict
+
+func (f HandlerFunc) HandlePacket(dir Direction, p *Packet, inj Injector) Verdict {
+	return f(dir, p, inj)
+}
+
+// Injector injects new packets into a Chain
+type Injector interface {
+	// Inject send p in direction dir, it continues from the handler after the
+	// injecting one. the chain takes the ownership of p
+	Inject(dir Direction, p *Packet) error
+}
+
+var (
+	_ BatchNIC    = (*Chain)(nil)
+	_ DeadlineNIC = (*Chain)(nil)
+)
+
+const chainBatchSize = 64
+
+// Chain wraps a NIC with an ordered list of packet handlers. Outbound packets
+// pass the handlers in order before being written to the NIC, inbound packets
+// pass them in reverse order, so the first handler is closest to the consumer.
+//
+// Ownership: packets dropped on the inbound path and injected packets are
+// released by the chain. packets dropped on the outbound path belong to the
+// caller of Write as usual.
+type Chain struct {
+	NIC
+	// QueueSize of inbound packets waiting for Read, default 512
+	QueueSize int
+
+	stages atomic.Pointer[[]*stage]
+	mu     sync.Mutex
+
+	inbound      chan *Packet
+	sendMu       sync.RWMutex // held by the senders to inbound
+	closed       bool
+	readErr      error
+	readDeadline Deadline
+	readDone     chan struct{}
+	closeChan    chan struct{}
+	initOnce     sync.Once
+	closeOnce    sync.Once
+}
+
+type stage struct {
+	h      Handler
+	index  int
+	stages []*stage
+	c      *Chain
+}
+
+func (s *stage) Inject(dir Direction, p *Packet) error {
+	if dir == Outbound {
+		return s.c.deliver(dir, p, s.stages, s.index+1)
+	}
+	return s.c.deliver(dir, p, s.stages, s.index-1)
+}
+
+func (c *Chain) init() {
+	c.initOnce.Do(func() {
+		c.inbound = make(chan *Packet, cmp.Or(c.QueueSize, 512))
+		c.readDone = make(chan struct{})
+		c.closeChan = make(chan struct{})
+		go c.pump()
+	})
+}
+
+// Use append handlers to the end of the chain, it is safe to call at runtime
+func (c *Chain) Use(handlers ...Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var old []*stage
+	if p := c.stages.Load(); p != nil {
+		old = *p
+	}
+	stages := make([]*stage, 0, len(old)+len(handlers))
+	for _, s := range old {
+		stages = append(stages, &stage{h: s.h, c: c})
+	}
+	for _, h := range handlers {
+		stages = append(stages, &stage{h: h, c: c})
+	}
+	for i, s := range stages {
+		s.index = i
+		s.stages = stages
+	}
+	c.stages.Store(&stages)
+}
+
+func (c *Chain) loadStages() []*stage {
+	if p := c.stages.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (c *Chain) pump() {
+	defer close(c.readDone)
+	pkts := make([]*Packet, chainBatchSize)
+	for {
+		n, err := ReadBatch(c.NIC, pkts)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		stages := c.loadStages()
+		for _, p := range pkts[:n] {
+			c.deliver(Inbound, p, stages, len(stages)-1)
+		}
+		clear(pkts[:n])
+	}
+}
+
+// deliver run an owned packet through stages starting at i and hand it over
+func (c *Chain) deliver(dir Direction, p *Packet, stages []*stage, i int) error {
+	if dir == Outbound {
+		for ; i < len(stages); i++ {
+			if stages[i].h.HandlePacket(dir, p, stages[i]) == Drop {
+				p.Release()
+				return nil
+			}
+		}
+		err := c.NIC.Write(p)
+		p.Release()
+		return err
+	}
+	for ; i >= 0; i-- {
+		if stages[i].h.HandlePacket(dir, p, stages[i]) == Drop {
+			p.Release()
+			return nil
+		}
+	}
+	c.init()
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+	if c.closed {
+		p.Release()
+		return net.ErrClosed
+	}
+	select {
+	case c.inbound <- p:
+		return nil
+	case <-c.closeChan:
+		p.Release()
+		return net.ErrClosed
+	}
+}
+
+// Read read the next inbound packet which passed all handlers
+func (c *Chain) Read() (*Packet, error) {
+	return c.ReadContext(context.Background())
+}
+
+// ReadContext read the next inbound packet which passed all handlers, the
+// underlying NIC keeps being read when ctx is done
+func (c *Chain) ReadContext(ctx context.Context) (*Packet, error) {
+	c.init()
+	select {
+	case p := <-c.inbound:
+		return p, nil
+	case <-c.closeChan:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.readDeadline.Done():
+		return nil, os.ErrDeadlineExceeded
+	case <-c.readDone:
+		select {
+		case p := <-c.inbound:
+			return p, nil
+		default:
+		}
+		return nil, c.readErr
+	}
+}
+
+func (c *Chain) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *Chain) ReadDeadline() time.Time {
+	return c.readDeadline.Time()
+}
+
+// ReadBatch block until one packet passed all handlers, then take the queued
+// ones without blocking
+func (c *Chain) ReadBatch(pkts []*Packet) (int, error) {
+	return FillBatch(pkts, c.Read, func() *Packet {
+		select {
+		case p := <-c.inbound:
+			return p
+		default:
+			return nil
+		}
+	})
+}
+
+// Write pass p through all handlers and write it to the NIC
+func (c *Chain) Write(p *Packet) error {
+	for _, s := range c.loadStages() {
+		if s.h.HandlePacket(Outbound, p, s) == Drop {
+			return nil
+		}
+	}
+	return c.NIC.Write(p)
+}
+
+func (c *Chain) Close() error {
+	c.init()
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		// wait for the senders to leave, the later ones see closed
+		c.sendMu.Lock()
+		defer c.sendMu.Unlock()
+		c.closed = true
+	drain:
+		for {
+			select {
+			case p := <-c.inbound:
+				p.Release()
+			default:
+				break drain
+			}
+		}
+	})
+	return c.NIC.Close()
+}
+
+// WriteBatch pass pkts through all handlers and write the remaining ones to
+// the NIC in one batch. the returned count includes the dropped packets, on
+// error it is the count of pkts before the first one not written
+func (c *Chain) WriteBatch(pkts []*Packet) (int, error) {
+	stages := c.loadStages()
+	if len(stages) == 0 {
+		return WriteBatch(c.NIC, pkts)
+	}
+	pass := make([]*Packet, 0, len(pkts))
+	index := make([]int, 0, len(pkts)) // of pass in pkts
+next:
+	for i, p := range pkts {
+		for _, s := range stages {
+			if s.h.HandlePacket(Outbound, p, s) == Drop {
+				continue next
+			}
+		}
+		pass = append(pass, p)
+		index = append(index, i)
+	}
+	n, err := WriteBatch(c.NIC, pass)
+	if err != nil && n < len(pass) {
+		return index[n], err
+	}
+	return len(pkts), err
+}
@@ -0,0 +1,261 @@
+package waiter_test
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+// recorder a handler logging the packets it sees as "direction data", it
+// drops those listed in drop
+type recorder struct {
+	name string
+	drop []string
+	mu   *sync.Mutex
+	log  *[]string
+}
+
+func (r recorder) HandlePacket(dir nic.Direction, p *nic.Packet, inj nic.Injector) nic.Verdict {
+	seen := dir.String() + " " + string(p.AsBytes())
+	r.mu.Lock()
+	*r.log = append(*r.log, r.name+" "+seen)
+	r.mu.Unlock()
+	if slices.Contains(r.drop, seen) {
+		return nic.Drop
+	}
+	return nic.Pass
+}
+
+func newPacket(pool *nic.PacketPool, data string) *nic.Packet {
+	p := pool.Get()
+	p.Write([]byte(data))
+	return p
+}
+
+// waitOutstanding wait until the packets of pool are all released
+func waitOutstanding(t *testing.T, pool *nic.PacketPool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); pool.Stats().Outstanding != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("packets not released: %+v\n%s", pool.Stats(), strings.Join(pool.Leaks(), "\n"))
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	c := &nic.Chain{NIC: a}
+	defer c.Close()
+	var mu sync.Mutex
+	var log []string
+	c.Use(recorder{name: "A", mu: &mu, log: &log})
+	c.Use(recorder{name: "B", mu: &mu, log: &log})
+
+	pool := nic.NewPacketPool(1500)
+	p := newPacket(pool, "out")
+	if err := c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	p = newPacket(pool, "in")
+	if err := b.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	if p, err := c.Read(); err != nil {
+		t.Fatal(err)
+	} else {
+		p.Release()
+	}
+
+	// the first handler is closest to the consumer
+	want := []string{"A outbound out", "B outbound out", "B inbound in", "A inbound in"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(log, want) {
+		t.Fatalf("handlers ran %q, want %q", log, want)
+	}
+}
+
+func TestChainOwnership(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	pool.Debug = true // a double release panics
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	c := &nic.Chain{NIC: a}
+	defer c.Close()
+	var mu sync.Mutex
+	var log []string
+	c.Use(recorder{name: "A", drop: []string{"outbound x-out", "inbound rx"}, mu: &mu, log: &log})
+	// R reflects the outbound packets starting with r, the copies continue
+	// inbound from A
+	c.Use(nic.HandlerFunc(func(dir nic.Direction, p *nic.Packet, inj nic.Injector) nic.Verdict {
+		if dir == nic.Outbound && p.AsBytes()[0] == 'r' {
+			if err := inj.Inject(nic.Inbound, p.Clone()); err != nil {
+				t.Errorf("inject: %v", err)
+			}
+		}
+		return nic.Pass
+	}))
+	c.Use(recorder{name: "B", drop: []string{"inbound y-in"}, mu: &mu, log: &log})
+
+	// an outbound packet dropped still belongs to the caller
+	p := newPacket(pool, "x-out")
+	if err := c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if string(p.AsBytes()) != "x-out" {
+		t.Fatalf("dropped packet changed to %q", p.AsBytes())
+	}
+	p.Release()
+
+	// an injected packet belongs to the chain, then to the reader
+	p = newPacket(pool, "r-out")
+	if err := c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	got, err := c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.AsBytes()) != "r-out" || !got.Shared() {
+		t.Fatalf("read %q, shared %v", got.AsBytes(), got.Shared())
+	}
+	got.Release()
+	if p, err := b.Read(); err != nil {
+		t.Fatal(err)
+	} else {
+		p.Release()
+	}
+
+	// an inbound packet dropped is released by the chain, the chain reads
+	// its nic since the first Read
+	p = newPacket(pool, "y-in")
+	b.Write(p)
+	p.Release()
+	waitOutstanding(t, pool)
+
+	// an injected packet dropped further on is released by the chain
+	p = newPacket(pool, "rx")
+	c.Write(p)
+	p.Release()
+	if p, err := b.Read(); err != nil {
+		t.Fatal(err)
+	} else {
+		p.Release()
+	}
+	waitOutstanding(t, pool)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"A outbound x-out",
+		"A outbound r-out", "A inbound r-out", "B outbound r-out",
+		"B inbound y-in",
+		"A outbound rx", "A inbound rx", "B outbound rx",
+	}
+	if !slices.Equal(log, want) {
+		t.Fatalf("handlers ran %q, want %q", log, want)
+	}
+}
+
+// failingNIC fails the writes of packets starting with 'f'
+type failingNIC struct {
+	nic.NIC
+	written []string
+}
+
+var errWrite = errors.New("write failed")
+
+func (n *failingNIC) Write(p *nic.Packet) error {
+	if p.AsBytes()[0] == 'f' {
+		return errWrite
+	}
+	n.written = append(n.written, string(p.AsBytes()))
+	return nil
+}
+
+func TestChainWriteBatch(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	fn := &failingNIC{NIC: a}
+	c := &nic.Chain{NIC: fn}
+	defer c.Close()
+	var mu sync.Mutex
+	var log []string
+	c.Use(recorder{name: "A", drop: []string{"outbound d"}, mu: &mu, log: &log})
+
+	pool := nic.NewPacketPool(1500)
+	var pkts []*nic.Packet
+	for _, s := range []string{"a", "d", "b"} {
+		pkts = append(pkts, newPacket(pool, s))
+	}
+	defer func() {
+		for _, p := range pkts {
+			p.Release()
+		}
+	}()
+	// the dropped packets count as written
+	if n, err := c.WriteBatch(pkts); n != 3 || err != nil {
+		t.Fatalf("write batch: %d, %v", n, err)
+	}
+
+	// on error the count is of the packets before the first one not written
+	pkts = append(pkts, newPacket(pool, "f"), newPacket(pool, "c"))
+	fn.written = nil
+	n, err := c.WriteBatch(pkts)
+	if n != 3 || !errors.Is(err, errWrite) {
+		t.Fatalf("failing write batch: %d, %v", n, err)
+	}
+	if !slices.Equal(fn.written, []string{"a", "b"}) {
+		t.Fatalf("wrote %q", fn.written)
+	}
+}
+
+func TestChainClose(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	c := &nic.Chain{NIC: a}
+	var inj nic.Injector
+	c.Use(nic.HandlerFunc(func(dir nic.Direction, p *nic.Packet, i nic.Injector) nic.Verdict {
+		inj = i
+		if dir == nic.Outbound {
+			i.Inject(nic.Inbound, p.Clone())
+			return nic.Drop
+		}
+		return nic.Pass
+	}))
+
+	// the injected packets wait in the queue, nobody reads them
+	for range 10 {
+		p := newPacket(pool, "queued")
+		c.Write(p)
+		p.Release()
+	}
+	if s := pool.Stats(); s.Outstanding != 10 {
+		t.Fatalf("%d packets queued, want 10", s.Outstanding)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitOutstanding(t, pool)
+
+	if _, err := c.Read(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close: %v", err)
+	}
+	// an inject after close is refused and the packet released
+	if err := inj.Inject(nic.Inbound, newPacket(pool, "late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("inject after close: %v", err)
+	}
+	waitOutstanding(t, pool)
+}
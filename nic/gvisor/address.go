@@ -0,0 +1,228 @@
+package gvisor
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Route a route of the nic, an invalid Gateway means the destination is on link
+type Route struct {
+	Destination netip.Prefix
+	Gateway     netip.Addr
+}
+
+func (r Route) String() string {
+	if r.Gateway.IsValid() {
+		return r.Destination.String() + " via " + r.Gateway.String()
+	}
+	return r.Destination.String()
+}
+
+// AddAddress add an address with its prefix length to the nic and a route to
+// the prefix. a nic can have several addresses per family, the first one is
+// the primary address used by Listen and as dial source
+func (g *_Gvisor) AddAddress(prefix netip.Prefix) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	return g.addAddress(prefix)
+}
+
+func (g *_Gvisor) addAddress(prefix netip.Prefix) error {
+	prefix, err := unmapPrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("add address: %w", err)
+	}
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol:          protocolNumber(prefix.Addr()),
+		AddressWithPrefix: toAddressWithPrefix(prefix),
+	}
+	if err := g.Stack.AddProtocolAddress(g.nicID, protoAddr, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("add address %s: %s", prefix, err)
+	}
+	subnet := protoAddr.AddressWithPrefix.Subnet()
+	if !g.hasRoute(subnet, tcpip.Address{}) {
+		g.Stack.AddRoute(tcpip.Route{Destination: subnet, NIC: g.nicID})
+	}
+	return nil
+}
+
+// RemoveAddress remove an address from the nic, the route to its prefix is
+// removed with the last address in the prefix
+func (g *_Gvisor) RemoveAddress(addr netip.Addr) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	var subnet tcpip.Subnet
+	for _, prefix := range g.Addresses() {
+		if prefix.Addr() == addr.Unmap() {
+			subnet = toAddressWithPrefix(prefix).Subnet()
+		}
+	}
+	if err := g.Stack.RemoveAddress(g.nicID, tcpip.AddrFromSlice(addr.Unmap().AsSlice())); err != nil {
+		return fmt.Errorf("remove address %s: %s", addr, err)
+	}
+	for _, prefix := range g.Addresses() {
+		if toAddressWithPrefix(prefix).Subnet() == subnet {
+			return nil
+		}
+	}
+	g.Stack.RemoveRoutes(func(r tcpip.Route) bool {
+		return r.NIC == g.nicID && r.Destination == subnet && r.Gateway.Len() == 0
+	})
+	return nil
+}
+
+// Addresses get the addresses of the nic
+func (g *_Gvisor) Addresses() []netip.Prefix {
+	if g.init() != nil {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for _, protoAddr := range g.Stack.AllAddresses()[g.nicID] {
+		addr, _ := netip.AddrFromSlice(protoAddr.AddressWithPrefix.Address.AsSlice())
+		if addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || addr.IsMulticast() {
+			continue // added by the stack
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, protoAddr.AddressWithPrefix.PrefixLen))
+	}
+	return prefixes
+}
+
+// AddRoute route dst through the nic, via gateway if it is valid
+func (g *_Gvisor) AddRoute(dst netip.Prefix, gateway netip.Addr) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	route, err := toRoute(dst, gateway)
+	if err != nil {
+		return fmt.Errorf("add route: %w", err)
+	}
+	if g.hasRoute(route.Destination, route.Gateway) {
+		return fmt.Errorf("add route %s: route exists", Route{dst, gateway})
+	}
+	route.NIC = g.nicID
+	g.Stack.AddRoute(route)
+	return nil
+}
+
+// RemoveRoute remove a route added by AddRoute or AddAddress
+func (g *_Gvisor) RemoveRoute(dst netip.Prefix, gateway netip.Addr) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	route, err := toRoute(dst, gateway)
+	if err != nil {
+		return fmt.Errorf("remove route: %w", err)
+	}
+	n := g.Stack.RemoveRoutes(func(r tcpip.Route) bool {
+		return r.NIC == g.nicID && r.Destination == route.Destination && r.Gateway == route.Gateway
+	})
+	if n == 0 {
+		return fmt.Errorf("remove route %s: no such route", Route{dst, gateway})
+	}
+	return nil
+}
+
+// Routes get the routes of the nic in lookup order
+func (g *_Gvisor) Routes() []Route {
+	if g.init() != nil {
+		return nil
+	}
+	var routes []Route
+	for _, r := range g.Stack.GetRouteTable() {
+		if r.NIC != g.nicID {
+			continue
+		}
+		id := r.Destination.ID()
+		dst, _ := netip.AddrFromSlice(id.AsSlice())
+		route := Route{Destination: netip.PrefixFrom(dst, r.Destination.Prefix())}
+		if r.Gateway.Len() > 0 {
+			route.Gateway, _ = netip.AddrFromSlice(r.Gateway.AsSlice())
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func (g *_Gvisor) hasRoute(dst tcpip.Subnet, gateway tcpip.Address) bool {
+	for _, r := range g.Stack.GetRouteTable() {
+		if r.NIC == g.nicID && r.Destination == dst && r.Gateway == gateway {
+			return true
+		}
+	}
+	return false
+}
+
+// mainAddress the primary address of a family, empty if there is none
+func (g *_Gvisor) mainAddress(pn tcpip.NetworkProtocolNumber) tcpip.Address {
+	if g.init() != nil {
+		return tcpip.Address{}
+	}
+	addr, err := g.Stack.GetMainNICAddress(g.nicID, pn)
+	if err != nil {
+		return tcpip.Address{}
+	}
+	return addr.Address
+}
+
+func (g *_Gvisor) hasV4() bool {
+	return g.mainAddress(ipv4.ProtocolNumber).Len() > 0
+}
+
+func (g *_Gvisor) hasV6() bool {
+	return g.mainAddress(ipv6.ProtocolNumber).Len() > 0
+}
+
+func toRoute(dst netip.Prefix, gateway netip.Addr) (tcpip.Route, error) {
+	dst, err := unmapPrefix(dst)
+	if err != nil {
+		return tcpip.Route{}, err
+	}
+	dst = dst.Masked()
+	subnet := toAddressWithPrefix(dst).Subnet()
+	var route tcpip.Route
+	route.Destination = subnet
+	if gateway.IsValid() {
+		if gateway.Unmap().Is4() != dst.Addr().Is4() {
+			return tcpip.Route{}, errors.New("gateway and destination families differ")
+		}
+		route.Gateway = tcpip.AddrFromSlice(gateway.Unmap().AsSlice())
+	}
+	return route, nil
+}
+
+// unmapPrefix turn a 4-in-6 prefix into an ipv4 one, the stack and
+// RemoveAddress see mapped addresses as ipv4
+func unmapPrefix(prefix netip.Prefix) (netip.Prefix, error) {
+	if !prefix.IsValid() {
+		return prefix, fmt.Errorf("invalid prefix %s", prefix)
+	}
+	if !prefix.Addr().Is4In6() {
+		return prefix, nil
+	}
+	if prefix.Bits() < 96 {
+		return prefix, fmt.Errorf("mapped prefix %s shorter than /96", prefix)
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96), nil
+}
+
+func toAddressWithPrefix(prefix netip.Prefix) tcpip.AddressWithPrefix {
+	return tcpip.AddressWithPrefix{
+		Address:   tcpip.AddrFromSlice(prefix.Addr().AsSlice()),
+		PrefixLen: prefix.Bits(),
+	}
+}
+
+func protocolNumber(addr netip.Addr) tcpip.NetworkProtocolNumber {
+	if addr.Is4() {
+		return ipv4.ProtocolNumber
+	}
+	return ipv6.ProtocolNumber
+}
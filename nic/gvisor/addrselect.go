@@ -0,0 +1,258 @@
+package gvisor
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// connectionAttemptDelay the delay between two connection attempts of Happy
+// Eyeballs, RFC 8305 section 5
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// sortByRFC6724 sort the destination addresses by the rules of RFC 6724
+// section 6, with the source addresses the nic would use to reach them
+func (g *_Gvisor) sortByRFC6724(addrs []netip.Addr) {
+	if len(addrs) < 2 {
+		return
+	}
+	type dest struct {
+		addr, src netip.Addr
+		srcOK     bool
+		attr      policyAttr
+		srcAttr   policyAttr
+	}
+	dests := make([]dest, len(addrs))
+	for i, addr := range addrs {
+		src, ok := g.sourceAddr(addr)
+		dests[i] = dest{addr: addr, src: src, srcOK: ok, attr: classify(addr), srcAttr: classify(src)}
+	}
+	slices.SortStableFunc(dests, func(da, db dest) int {
+		// rule 1: avoid unusable destinations
+		if da.srcOK != db.srcOK {
+			return prefer(da.srcOK)
+		}
+		// rule 2: prefer matching scope
+		if a, b := da.attr.scope == da.srcAttr.scope, db.attr.scope == db.srcAttr.scope; a != b {
+			return prefer(a)
+		}
+		// rules 3 and 4 need deprecated and home addresses, the stack has neither
+		// rule 5: prefer matching label
+		if a, b := da.attr.label == da.srcAttr.label, db.attr.label == db.srcAttr.label; a != b {
+			return prefer(a)
+		}
+		// rule 6: prefer higher precedence
+		if da.attr.precedence != db.attr.precedence {
+			return prefer(da.attr.precedence > db.attr.precedence)
+		}
+		// rule 7 needs the transport, everything is native here
+		// rule 8: prefer smaller scope
+		if da.attr.scope != db.attr.scope {
+			return prefer(da.attr.scope < db.attr.scope)
+		}
+		// rule 9: use longest matching prefix, IPv6 only like the stdlib
+		if da.addr.Is6() && db.addr.Is6() && da.srcOK && db.srcOK {
+			if a, b := commonPrefixLen(da.src, da.addr), commonPrefixLen(db.src, db.addr); a != b {
+				return prefer(a > b)
+			}
+		}
+		// rule 10: otherwise leave the order unchanged
+		return 0
+	})
+	for i, d := range dests {
+		addrs[i] = d.addr
+	}
+}
+
+func prefer(a bool) int {
+	if a {
+		return -1
+	}
+	return 1
+}
+
+// sourceAddr the address the stack would send from to reach dst
+func (g *_Gvisor) sourceAddr(dst netip.Addr) (netip.Addr, bool) {
+	fa, pn := g.fullAddr(netip.AddrPortFrom(dst, 0))
+	r, err := g.Stack.FindRoute(g.nicID, tcpip.Address{}, fa.Addr, pn, false)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer r.Release()
+	src := r.LocalAddress()
+	return netip.AddrFromSlice(src.AsSlice())
+}
+
+type policyAttr struct {
+	precedence, label uint8
+	scope             uint8
+}
+
+// policyTable the default policy table of RFC 6724 section 2.1, longest
+// prefixes first
+var policyTable = []struct {
+	prefix            netip.Prefix
+	precedence, label uint8
+}{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+// classify the policy attributes and scope of addr, IPv4 addresses are
+// classified as IPv4-mapped IPv6
+func classify(addr netip.Addr) policyAttr {
+	if !addr.IsValid() {
+		return policyAttr{}
+	}
+	mapped := netip.AddrFrom16(addr.As16())
+	var attr policyAttr
+	for _, p := range policyTable {
+		if p.prefix.Contains(mapped) {
+			attr.precedence, attr.label = p.precedence, p.label
+			break
+		}
+	}
+	switch {
+	case addr.Is6() && addr.IsMulticast():
+		attr.scope = addr.As16()[1] & 0xf
+	case addr.IsLoopback() || addr.IsLinkLocalUnicast():
+		attr.scope = scopeLinkLocal
+	case addr.Is6() && netip.MustParsePrefix("fec0::/10").Contains(addr):
+		attr.scope = scopeSiteLocal
+	default:
+		attr.scope = scopeGlobal
+	}
+	return attr
+}
+
+func commonPrefixLen(a, b netip.Addr) int {
+	a16, b16 := a.As16(), b.As16()
+	// RFC 6724 compares up to the 64 bit prefix length of the source
+	n := 0
+	for i := 0; i < 8; i++ {
+		x := a16[i] ^ b16[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		return n
+	}
+	return n
+}
+
+// interleaveFamilies alternate the address families starting with the
+// family of the first address, RFC 8305 section 4
+func interleaveFamilies(addrs []netip.AddrPort) []netip.AddrPort {
+	var first, second []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	out := make([]netip.AddrPort, 0, len(addrs))
+	for i := 0; i < max(len(first), len(second)); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialHappyEyeballs race TCP connections to addrs, RFC 8305. an attempt
+// starts every connectionAttemptDelay or as soon as the previous one fails,
+// the first established connection wins and the others are abandoned
+func (g *_Gvisor) dialHappyEyeballs(ctx context.Context, addrs []netip.AddrPort) (net.Conn, error) {
+	addrs = interleaveFamilies(addrs)
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := g.DialContextTCPAddrPort(attemptCtx, addr)
+			if err != nil {
+				results <- result{nil, err}
+				return
+			}
+			results <- result{c, nil}
+		}()
+	}
+	abandon := func(pending int) {
+		go func() {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.c != nil {
+					r.c.Close()
+				}
+			}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				abandon(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-ctx.Done():
+			abandon(pending)
+			err := errCanceled
+			if ctx.Err() == context.DeadlineExceeded {
+				err = errTimeout
+			}
+			return nil, &net.OpError{Op: "dial", Err: err}
+		}
+	}
+	return nil, firstErr
+}
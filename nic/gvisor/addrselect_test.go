@@ -0,0 +1,114 @@
+package gvisor
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+func createDual(t *testing.T, v4, v6 string) *_Gvisor {
+	t.Helper()
+	g, err := Create(nic.Config{MTU: 1500, IPv4: v4, IPv6: v6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+func TestLookupHostRFC6724(t *testing.T) {
+	hosts := map[string][]netip.Addr{
+		"mixed.test": {
+			netip.MustParseAddr("2001:db8:1::9"), // no route
+			netip.MustParseAddr("fd00::9"),
+			netip.MustParseAddr("10.0.0.9"),
+			netip.MustParseAddr("2001:db8::9"),
+		},
+	}
+	for _, tc := range []struct {
+		name string
+		v6   string
+		want []string
+	}{
+		// a global IPv6 destination has precedence over IPv4, a ULA does not
+		{"global", "2001:db8::1/64", []string{"2001:db8::9", "10.0.0.9", "2001:db8:1::9", "fd00::9"}},
+		{"ula", "fd00::1/64", []string{"10.0.0.9", "fd00::9", "2001:db8:1::9", "2001:db8::9"}},
+	} {
+		g := createDual(t, "10.0.0.1/24", tc.v6)
+		if err := g.SetResolverConfig(ResolverConfig{Hosts: hosts}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := g.LookupContextHost(context.Background(), "mixed.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	// the hosts table keeps its order
+	if hosts["mixed.test"][0] != netip.MustParseAddr("2001:db8:1::9") {
+		t.Fatalf("hosts table sorted: %v", hosts["mixed.test"])
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	client := createDual(t, "10.0.0.1/24", "2001:db8::1/64")
+	server := createDual(t, "10.0.0.2/24", "2001:db8::2/64")
+	link(t, client, server)
+	serve(t, server) // tcp4 only, the IPv6 address does not answer
+	// 10.0.0.3 and 2001:db8::3 are nobody's, their packets are lost
+	if err := client.SetResolverConfig(ResolverConfig{Hosts: map[string][]netip.Addr{
+		"v4.test": {netip.MustParseAddr("2001:db8::3"), netip.MustParseAddr("10.0.0.2")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the IPv6 address is tried first, IPv4 starts after the attempt delay
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.DialContext(ctx, "tcp", "v4.test:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "10.0.0.2:8080" {
+		t.Fatalf("connected to %s", got)
+	}
+	if d := time.Since(start); d < connectionAttemptDelay || d > connectionAttemptDelay+time.Second {
+		t.Fatalf("fell back to IPv4 after %s", d)
+	}
+
+	// a refused IPv6 attempt starts the IPv4 one at once
+	if err := client.SetResolverConfig(ResolverConfig{Hosts: map[string][]netip.Addr{
+		"refused.test": {netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("10.0.0.2")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	c2, err := client.DialContext(ctx, "tcp", "refused.test:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+	if d := time.Since(start); d >= connectionAttemptDelay {
+		t.Fatalf("fell back to IPv4 after %s", d)
+	}
+
+	// both families dead, the dial ends with its context
+	if err := client.SetResolverConfig(ResolverConfig{Hosts: map[string][]netip.Addr{
+		"dead.test": {netip.MustParseAddr("2001:db8::3"), netip.MustParseAddr("10.0.0.3")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	deadCtx, deadCancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer deadCancel()
+	if _, err := client.DialContext(deadCtx, "tcp", "dead.test:8080"); err == nil {
+		t.Fatal("dialed a dead host")
+	}
+}
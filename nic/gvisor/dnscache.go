@@ -0,0 +1,291 @@
+package gvisor
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSCacheSize   = 1024
+	defaultDNSCacheMaxTTL = 24 * time.Hour
+)
+
+// DNSCacheEntry a cached DNS answer
+type DNSCacheEntry struct {
+	Name string
+	Type dnsmessage.Type
+	// Negative the name or the record type does not exist
+	Negative bool
+	// Server which answered
+	Server string
+	// TTL remaining time to live
+	TTL time.Duration
+}
+
+// DNSCacheStats counters of the DNS cache
+type DNSCacheStats struct {
+	Entries      int
+	Hits, Misses uint64
+}
+
+type dnsCacheKey struct {
+	name  string // lowercase fqdn
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	msg      []byte
+	server   string
+	err      error
+	received time.Time
+	expires  time.Time
+}
+
+// dnsLRU the methods used of the lru cache of the waiter package
+type dnsLRU interface {
+	Get(dnsCacheKey) (*dnsCacheEntry, bool)
+	Put(dnsCacheKey, *dnsCacheEntry)
+	Del(dnsCacheKey)
+	Clear()
+	Dump() map[dnsCacheKey]*dnsCacheEntry
+}
+
+// dnsFlight a query in progress, concurrent identical queries wait for it
+type dnsFlight struct {
+	done     chan struct{}
+	msg      []byte
+	server   string
+	err      error
+	received time.Time
+}
+
+// dnsFlightKey a flight is only shared by the queries of the same config
+type dnsFlightKey struct {
+	dnsCacheKey
+	conf *resolverConf
+}
+
+type dnsCache struct {
+	mu      sync.Mutex
+	entries dnsLRU
+	size    int
+	flights map[dnsFlightKey]*dnsFlight
+
+	hits, misses atomic.Uint64
+}
+
+// query resolve name through the cache, concurrent identical queries share
+// one exchange with the servers. the exchange is not canceled with the ctx of
+// the first query, it is bounded by the timeouts of the resolver config.
+// received is when the answer came from the server, the TTLs of msg count
+// from then
+func (g *_Gvisor) query(ctx context.Context, conf *resolverConf, name string, qtype dnsmessage.Type) (msg []byte, server string, received time.Time, err error) {
+	c := &g.dnsCache
+	key := dnsCacheKey{name: strings.ToLower(name), qtype: qtype}
+
+	c.mu.Lock()
+	if e, ok := c.get(key, conf); ok {
+		c.mu.Unlock()
+		return e.msg, e.server, e.received, e.err
+	}
+	fk := dnsFlightKey{key, conf}
+	f, ok := c.flights[fk]
+	if !ok {
+		f = &dnsFlight{done: make(chan struct{})}
+		if c.flights == nil {
+			c.flights = make(map[dnsFlightKey]*dnsFlight)
+		}
+		c.flights[fk] = f
+		go g.fly(context.WithoutCancel(ctx), fk, f, name, qtype)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.msg, f.server, f.received, f.err
+	case <-ctx.Done():
+		err := errCanceled
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errTimeout
+		}
+		return nil, "", time.Time{}, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: err == errTimeout}
+	}
+}
+
+// fly run the exchange of a flight and cache its answer, unless the config
+// was replaced meanwhile
+func (g *_Gvisor) fly(ctx context.Context, fk dnsFlightKey, f *dnsFlight, name string, qtype dnsmessage.Type) {
+	conf := fk.conf
+	set := conf.route(name)
+	ctx, cancel := context.WithTimeout(ctx, set.timeout*time.Duration(set.attempts*max(len(set.servers), 1)))
+	defer cancel()
+	f.msg, f.server, f.err = g.tryOneName(ctx, conf, name, qtype)
+	f.received = time.Now()
+
+	c := &g.dnsCache
+	c.mu.Lock()
+	delete(c.flights, fk)
+	// SetResolverConfig flushes the cache after the swap, under c.mu
+	if ttl, ok := cacheTTL(f.msg, f.err); ok && g.resolver.Load() == conf {
+		c.put(fk.dnsCacheKey, &dnsCacheEntry{
+			msg:      f.msg,
+			server:   f.server,
+			err:      f.err,
+			received: f.received,
+			expires:  f.received.Add(min(ttl, conf.cacheMaxTTL)),
+		}, conf)
+	}
+	c.mu.Unlock()
+	close(f.done)
+}
+
+func (c *dnsCache) get(key dnsCacheKey, conf *resolverConf) (*dnsCacheEntry, bool) {
+	if conf.cacheSize <= 0 {
+		return nil, false
+	}
+	if c.entries != nil {
+		e, ok := c.entries.Get(key)
+		if ok && time.Now().Before(e.expires) {
+			c.hits.Add(1)
+			return e, true
+		}
+		if ok {
+			c.entries.Del(key)
+		}
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+func (c *dnsCache) put(key dnsCacheKey, e *dnsCacheEntry, conf *resolverConf) {
+	if conf.cacheSize <= 0 {
+		return
+	}
+	if c.entries == nil || c.size != conf.cacheSize {
+		c.entries = nic.New[dnsCacheKey, *dnsCacheEntry](conf.cacheSize)
+		c.size = conf.cacheSize
+	}
+	c.entries.Put(key, e)
+}
+
+// cacheTTL how long the answer can be cached, the minimum TTL of the answer
+// records or the SOA minimum of a negative answer
+func cacheTTL(msg []byte, err error) (time.Duration, bool) {
+	if msg == nil {
+		return 0, false
+	}
+	p, _, perr := answerParser(msg)
+	if perr != nil {
+		return 0, false
+	}
+	if err == nil {
+		ttl := uint32(math.MaxUint32)
+		for {
+			h, err := p.AnswerHeader()
+			if err != nil {
+				break
+			}
+			ttl = min(ttl, h.TTL)
+			if err := p.SkipAnswer(); err != nil {
+				return 0, false
+			}
+		}
+		return time.Duration(ttl) * time.Second, ttl > 0 && ttl != math.MaxUint32
+	}
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		return 0, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return 0, false
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return 0, false
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0, false
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0, false
+		}
+		ttl := min(h.TTL, soa.MinTTL)
+		return time.Duration(ttl) * time.Second, ttl > 0
+	}
+}
+
+// DNSCache list the cached answers
+func (g *_Gvisor) DNSCache() []DNSCacheEntry {
+	c := &g.dnsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		return nil
+	}
+	now := time.Now()
+	var entries []DNSCacheEntry
+	for key, e := range c.entries.Dump() {
+		if ttl := e.expires.Sub(now); ttl > 0 {
+			entries = append(entries, DNSCacheEntry{
+				Name:     key.name,
+				Type:     key.qtype,
+				Negative: e.err != nil,
+				Server:   e.server,
+				TTL:      ttl,
+			})
+		}
+	}
+	slices.SortFunc(entries, func(a, b DNSCacheEntry) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+	return entries
+}
+
+// FlushDNSCache drop the cached answers of names, or all answers without names
+func (g *_Gvisor) FlushDNSCache(names ...string) {
+	c := &g.dnsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		return
+	}
+	if len(names) == 0 {
+		c.entries.Clear()
+		return
+	}
+	fqdns := make([]string, 0, len(names))
+	for _, name := range names {
+		fqdns = append(fqdns, strings.ToLower(strings.TrimSuffix(name, "."))+".")
+	}
+	for key := range c.entries.Dump() {
+		if slices.Contains(fqdns, key.name) {
+			c.entries.Del(key)
+		}
+	}
+}
+
+// DNSCacheStats get the cache counters
+func (g *_Gvisor) DNSCacheStats() DNSCacheStats {
+	c := &g.dnsCache
+	c.mu.Lock()
+	var n int
+	if c.entries != nil {
+		n = len(c.entries.Dump())
+	}
+	c.mu.Unlock()
+	return DNSCacheStats{Entries: n, Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
@@ -0,0 +1,67 @@
+package gvisor
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestConfigSwappedInFlight a query of the replaced config is not shared
+// with the new one and its answer is not cached
+func TestConfigSwappedInFlight(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	up := create(t, "10.0.0.2/24")
+	link(t, g, up)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	old := zoneStandIn(rr("a.example.com.", &dnsmessage.AResource{A: [4]byte{1, 1, 1, 1}}))
+	udpServer(t, up, "10.0.0.2:53", func(req []byte) []byte {
+		once.Do(func() { close(started) })
+		<-release
+		return old(req)
+	})
+	udpServer(t, up, "10.0.0.2:5353", zoneStandIn(rr("a.example.com.", &dnsmessage.AResource{A: [4]byte{2, 2, 2, 2}})))
+
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	oldAddrs := make(chan []string, 1)
+	go func() {
+		addrs, _ := g.LookupContextHost(ctx, "a.example.com")
+		oldAddrs <- addrs
+	}()
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("the old server got no query")
+	}
+
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2:5353"}}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func() []string {
+		addrs, err := g.LookupContextHost(ctx, "a.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrs
+	}
+	if addrs := lookup(); !slices.Equal(addrs, []string{"2.2.2.2"}) {
+		t.Fatalf("lookup with the new config: %v", addrs)
+	}
+	g.FlushDNSCache()
+	close(release)
+	if addrs := <-oldAddrs; !slices.Equal(addrs, []string{"1.1.1.1"}) {
+		t.Fatalf("lookup with the old config: %v", addrs)
+	}
+	if addrs := lookup(); !slices.Equal(addrs, []string{"2.2.2.2"}) {
+		t.Fatalf("answer of the old config cached: %v", addrs)
+	}
+}
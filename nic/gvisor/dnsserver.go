@@ -0,0 +1,430 @@
+package gvisor
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+const (
+	defaultPeerNameKey   = "name"
+	defaultPeerRecordTTL = 60 * time.Second
+	dnsServerIdleTimeout = 10 * time.Second
+	// dnsServerMaxInFlight UDP queries answered at once, the others are
+	// dropped and the clients retry
+	dnsServerMaxInFlight = 1024
+	// fakeIPRecordTTL short so the clients come back and refresh the mapping
+	fakeIPRecordTTL = 1
+)
+
+// DNSServerConfig configures the DNS server of ServeDNS
+type DNSServerConfig struct {
+	// Zone the peer names are served under, e.g. "peers.internal"
+	Zone string
+	// Peers named by their Meta, the server follows AddPeer and RemovePeer.
+	// without peers the server only forwards
+	Peers *nic.VirtualNIC
+	// NameKey the Meta key of the peer name, default "name"
+	NameKey string
+	// TTL of the peer records, default 60s
+	TTL time.Duration
+	// FakeIP when set, the A and AAAA queries of the names it matches are
+	// answered with its addresses instead of being forwarded
+	FakeIP *nic.FakeIPPool
+}
+
+// peerZone the records of the peers, rebuilt after the peers change
+type peerZone struct {
+	zone    string // lowercase fqdn
+	peers   *nic.VirtualNIC
+	nameKey string
+	ttl     uint32
+	fakeIP  *nic.FakeIPPool
+
+	mu     sync.Mutex
+	dirty  bool
+	serial uint32
+	names  map[string][]netip.Addr // lowercase fqdn
+	ptrs   map[string]string       // reverse name to fqdn
+}
+
+func newPeerZone(cfg DNSServerConfig) (*peerZone, error) {
+	z := &peerZone{
+		peers:   cfg.Peers,
+		nameKey: cmp.Or(cfg.NameKey, defaultPeerNameKey),
+		ttl:     uint32(cmp.Or(cfg.TTL, defaultPeerRecordTTL) / time.Second),
+		fakeIP:  cfg.FakeIP,
+		dirty:   true,
+	}
+	if cfg.Zone != "" {
+		zone := strings.ToLower(strings.TrimSuffix(cfg.Zone, "."))
+		if !isDomainName(zone) {
+			return nil, fmt.Errorf("invalid zone %q", cfg.Zone)
+		}
+		z.zone = zone + "."
+	} else if cfg.Peers != nil {
+		return nil, errors.New("zone is required to serve peers")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("negative ttl %s", cfg.TTL)
+	}
+	return z, nil
+}
+
+func (z *peerZone) invalidate() {
+	z.mu.Lock()
+	z.dirty = true
+	z.mu.Unlock()
+}
+
+func (z *peerZone) records() (map[string][]netip.Addr, map[string]string, uint32) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if !z.dirty {
+		return z.names, z.ptrs, z.serial
+	}
+	z.dirty = false
+	z.serial++
+	z.names = make(map[string][]netip.Addr)
+	z.ptrs = make(map[string]string)
+	if z.peers == nil {
+		return z.names, z.ptrs, z.serial
+	}
+	for _, p := range z.peers.Peers() {
+		label := strings.ToLower(strings.TrimSuffix(p.Meta.Get(z.nameKey), "."))
+		if label == "" || !isDomainName(label) {
+			continue
+		}
+		fqdn := label + "." + z.zone
+		for _, s := range []string{p.IPv4, p.IPv6} {
+			addr, ok := parsePeerAddr(s)
+			if !ok {
+				continue
+			}
+			z.names[fqdn] = append(z.names[fqdn], addr)
+			z.ptrs[reverseAddr(addr)] = fqdn
+		}
+	}
+	return z.names, z.ptrs, z.serial
+}
+
+// parsePeerAddr parse the ip or cidr of a peer
+func parsePeerAddr(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// authoritative whether name is answered from the peers
+func (z *peerZone) authoritative(name string) bool {
+	if z.zone != "" && (name == z.zone || strings.HasSuffix(name, "."+z.zone)) {
+		return true
+	}
+	_, ptrs, _ := z.records()
+	_, ok := ptrs[name]
+	return ok
+}
+
+// answer fill resp with the records of q
+func (z *peerZone) answer(resp *dnsmessage.Message, q dnsmessage.Question, name string) {
+	names, ptrs, serial := z.records()
+	resp.Header.Authoritative = true
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: z.ttl}
+	all := q.Type == dnsmessage.TypeALL
+	if target, ok := ptrs[name]; ok {
+		if q.Type == dnsmessage.TypePTR || all {
+			hdr.Type = dnsmessage.TypePTR
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(target)}})
+		}
+		return
+	}
+	if addrs, ok := names[name]; ok {
+		for _, addr := range addrs {
+			switch {
+			case addr.Is4() && (q.Type == dnsmessage.TypeA || all):
+				hdr.Type = dnsmessage.TypeA
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: addr.As4()}})
+			case addr.Is6() && (q.Type == dnsmessage.TypeAAAA || all):
+				hdr.Type = dnsmessage.TypeAAAA
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+	} else if name != z.zone {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	soa := z.soa(serial)
+	if name == z.zone && (q.Type == dnsmessage.TypeSOA || all) {
+		resp.Answers = append(resp.Answers, soa)
+	}
+	if len(resp.Answers) == 0 {
+		resp.Authorities = append(resp.Authorities, soa) // negative caching, RFC 2308
+	}
+}
+
+// fakeAnswer fill resp with the fake address of name, false when name is
+// not given fake addresses or q is not an address query
+func (z *peerZone) fakeAnswer(resp *dnsmessage.Message, q dnsmessage.Question, name string) bool {
+	if z.fakeIP == nil || (q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return false
+	}
+	domain := strings.TrimSuffix(name, ".")
+	if z.fakeIP.Match != nil && !z.fakeIP.Match(domain) {
+		return false
+	}
+	// without a prefix of the family the answer is empty, the client uses
+	// the other family. an exhausted pool fails the query
+	addr, err := z.fakeIP.Allocate(domain, q.Type == dnsmessage.TypeAAAA)
+	if errors.Is(err, nic.ErrFakeIPExhausted) {
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+		return true
+	}
+	if err != nil {
+		return true
+	}
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: fakeIPRecordTTL}
+	if addr.Is4() {
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: addr.As4()}})
+	} else {
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+	}
+	return true
+}
+
+func (z *peerZone) soa(serial uint32) dnsmessage.Resource {
+	zone := dnsmessage.MustNewName(z.zone)
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: z.ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns." + z.zone),
+			MBox:    dnsmessage.MustNewName("hostmaster." + z.zone),
+			Serial:  serial,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  z.ttl,
+		},
+	}
+}
+
+// ServeDNS answer DNS queries on UDP and TCP port 53 of the nic addresses
+// until ctx is done. the names under the zone and the reverse names of the
+// peers are answered from the peers, the names matched by the FakeIP pool
+// with fake addresses, other queries are forwarded to the servers of the
+// resolver config
+func (g *_Gvisor) ServeDNS(ctx context.Context, cfg DNSServerConfig) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	z, err := newPeerZone(cfg)
+	if err != nil {
+		return fmt.Errorf("dns server: %w", err)
+	}
+	if cfg.Peers != nil {
+		cancel := cfg.Peers.WatchPeers(func(nic.PeerEvent) { z.invalidate() })
+		defer cancel()
+	}
+
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	for _, pn := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		addr := g.mainAddress(pn)
+		if addr.Len() == 0 {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(addr.AsSlice())
+		c, err := g.ListenUDPAddrPort(netip.AddrPortFrom(ip, 53))
+		if err != nil {
+			return fmt.Errorf("dns server: %w", err)
+		}
+		closers = append(closers, c)
+		go g.serveDNSPackets(ctx, z, c)
+	}
+	if len(closers) == 0 {
+		return errors.New("dns server: nic has no address")
+	}
+	l, err := g.Listen("tcp", 53)
+	if err != nil {
+		return fmt.Errorf("dns server: %w", err)
+	}
+	closers = append(closers, l)
+	go g.serveDNSStreams(ctx, z, l)
+
+	<-ctx.Done()
+	return nil
+}
+
+func (g *_Gvisor) serveDNSPackets(ctx context.Context, z *peerZone, c *gonet.UDPConn) {
+	buf := make([]byte, 65535)
+	sem := make(chan struct{}, dnsServerMaxInFlight)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			continue
+		}
+		req := slices.Clone(buf[:n])
+		go func() {
+			defer func() { <-sem }()
+			if resp := g.serveDNSQuery(ctx, z, req, true); resp != nil {
+				c.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (g *_Gvisor) serveDNSStreams(ctx context.Context, z *peerZone, l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go g.serveDNSConn(ctx, z, c)
+	}
+}
+
+func (g *_Gvisor) serveDNSConn(ctx context.Context, z *peerZone, c net.Conn) {
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	var l [2]byte
+	for {
+		c.SetReadDeadline(time.Now().Add(dnsServerIdleTimeout))
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		resp := g.serveDNSQuery(ctx, z, req, false)
+		if resp == nil {
+			return
+		}
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveDNSQuery answer req, nil if req is not a query
+func (g *_Gvisor) serveDNSQuery(ctx context.Context, z *peerZone, req []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || msg.Header.Response {
+		return nil
+	}
+	maxSize := 65535
+	if udp {
+		maxSize = 512
+	}
+	var opt *dnsmessage.Resource
+	for i, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			opt = &msg.Additionals[i]
+			if udp {
+				maxSize = max(maxSize, int(rr.Header.Class)) // the udp payload size
+			}
+		}
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 msg.Header.ID,
+			Response:           true,
+			OpCode:             msg.Header.OpCode,
+			RecursionDesired:   msg.Header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: msg.Questions,
+	}
+	switch {
+	case msg.Header.OpCode != 0:
+		resp.Header.RCode = dnsmessage.RCodeNotImplemented
+	case len(msg.Questions) != 1:
+		resp.Header.RCode = dnsmessage.RCodeFormatError
+	default:
+		q := msg.Questions[0]
+		name := strings.ToLower(q.Name.String())
+		switch {
+		case z.authoritative(name):
+			z.answer(&resp, q, name)
+		case z.fakeAnswer(&resp, q, name):
+		default:
+			g.forwardDNS(ctx, &resp, q)
+		}
+	}
+	if opt != nil {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(maxDNSPacketSize, dnsmessage.RCodeSuccess, false)
+		resp.Additionals = append(resp.Additionals, dnsmessage.Resource{Header: rh, Body: &dnsmessage.OPTResource{}})
+	}
+	out, err := resp.Pack()
+	if err != nil || len(out) > maxSize {
+		return truncated(resp)
+	}
+	return out
+}
+
+// forwardDNS answer q with the resolver, through its cache. the records of
+// the answer are copied with the TTLs left since it was received, a TTL under
+// one second is rounded up to 1
+func (g *_Gvisor) forwardDNS(ctx context.Context, resp *dnsmessage.Message, q dnsmessage.Question) {
+	msg, _, received, _ := g.query(ctx, g.resolverConf(), q.Name.String(), q.Type)
+	var answer dnsmessage.Message
+	if msg == nil || answer.Unpack(msg) != nil {
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+		return
+	}
+	age := time.Since(received)
+	ttl := func(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+		out := make([]dnsmessage.Resource, 0, len(rrs))
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue // the server adds its own
+			}
+			left := time.Duration(rr.Header.TTL)*time.Second - age
+			rr.Header.TTL = uint32(max(left/time.Second, 1))
+			out = append(out, rr)
+		}
+		return out
+	}
+	resp.Header.RCode = answer.Header.RCode
+	resp.Header.AuthenticData = answer.Header.AuthenticData
+	resp.Answers = ttl(answer.Answers)
+	resp.Authorities = ttl(answer.Authorities)
+	resp.Additionals = ttl(answer.Additionals)
+}
+
+// truncated an empty response with the TC bit, the client retries over TCP
+func truncated(resp dnsmessage.Message) []byte {
+	resp.Header.Truncated = true
+	resp.Answers, resp.Authorities, resp.Additionals = nil, nil, nil
+	out, _ := resp.Pack()
+	return out
+}
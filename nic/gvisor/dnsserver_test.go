@@ -0,0 +1,326 @@
+package gvisor
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/pipe"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udpStandIn answer the queries on udp port 53 of g with dnsStandIn
+func udpStandIn(t *testing.T, g *_Gvisor) {
+	t.Helper()
+	udpServer(t, g, "10.0.0.2:53", dnsStandIn)
+}
+
+// udpServer answer the queries on addr of g with handle, a nil answer is
+// not sent. each query is handled on its own goroutine
+func udpServer(t *testing.T, g *_Gvisor, addr string, handle func(req []byte) []byte) {
+	t.Helper()
+	c, err := g.ListenUDPAddrPort(netip.MustParseAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := slices.Clone(buf[:n])
+			go func() {
+				if resp := handle(req); resp != nil {
+					c.WriteTo(resp, addr)
+				}
+			}()
+		}
+	}()
+}
+
+// zoneStandIn answer from records like a recursive server: the CNAMEs of
+// the name are followed, a name without records is NXDOMAIN
+func zoneStandIn(records ...dnsmessage.Resource) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+			return nil
+		}
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		msg.Header.RecursionAvailable = true
+		msg.Additionals = nil
+		name, found := q.Name, false
+		for hops := 0; hops < 16; hops++ {
+			var cname *dnsmessage.Resource
+			for i, rr := range records {
+				if !strings.EqualFold(rr.Header.Name.String(), name.String()) {
+					continue
+				}
+				found = true
+				switch {
+				case rr.Header.Type == q.Type:
+					msg.Answers = append(msg.Answers, rr)
+				case rr.Header.Type == dnsmessage.TypeCNAME:
+					cname = &records[i]
+				}
+			}
+			if cname == nil || q.Type == dnsmessage.TypeCNAME {
+				break
+			}
+			msg.Answers = append(msg.Answers, *cname)
+			name = cname.Body.(*dnsmessage.CNAMEResource).CNAME
+		}
+		if !found {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+		}
+		out, _ := msg.Pack()
+		return out
+	}
+}
+
+// rr a record with a TTL of 60s
+func rr(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	var typ dnsmessage.Type
+	switch body.(type) {
+	case *dnsmessage.AResource:
+		typ = dnsmessage.TypeA
+	case *dnsmessage.AAAAResource:
+		typ = dnsmessage.TypeAAAA
+	case *dnsmessage.CNAMEResource:
+		typ = dnsmessage.TypeCNAME
+	case *dnsmessage.MXResource:
+		typ = dnsmessage.TypeMX
+	case *dnsmessage.SRVResource:
+		typ = dnsmessage.TypeSRV
+	case *dnsmessage.TXTResource:
+		typ = dnsmessage.TypeTXT
+	case *dnsmessage.PTRResource:
+		typ = dnsmessage.TypePTR
+	case *dnsmessage.NSResource:
+		typ = dnsmessage.TypeNS
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   body,
+	}
+}
+
+// exchangeUDP send one query from g to server, retried until the server is up
+func exchangeUDP(t *testing.T, g *_Gvisor, server string, req []byte) dnsmessage.Message {
+	t.Helper()
+	c, err := g.DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 65535)
+	for range 50 {
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := c.Read(buf)
+		if err != nil {
+			continue
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	t.Fatalf("no answer from %s", server)
+	return dnsmessage.Message{}
+}
+
+func TestServeDNSForward(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	up := create(t, "10.0.0.2/24")
+	link(t, g, up)
+	udpStandIn(t, up)
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.ServeDNS(ctx, DNSServerConfig{}) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	query := func(id uint16) dnsmessage.Message {
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+		req, err := (&dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+			Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("A.Example.COM."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+			Additionals: []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.OPTResource{}}},
+		}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := exchangeUDP(t, up, "10.0.0.1:53", req)
+		if resp.Header.ID != id || len(resp.Questions) != 1 || resp.Questions[0].Name.String() != "A.Example.COM." {
+			t.Fatalf("response %d to %v", resp.Header.ID, resp.Questions)
+		}
+		var opts int
+		for _, rr := range resp.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				opts++
+				if rr.Header.Class != maxDNSPacketSize {
+					t.Fatalf("opt with payload size %d", rr.Header.Class)
+				}
+			}
+		}
+		if opts != 1 || len(resp.Answers) != 1 {
+			t.Fatalf("%d answers, %d opt records", len(resp.Answers), opts)
+		}
+		return resp
+	}
+
+	if ttl := query(1).Answers[0].Header.TTL; ttl == 0 || ttl > 60 {
+		t.Fatalf("fresh answer with ttl %d", ttl)
+	}
+	// age the cached answer, the remaining half second is rounded up
+	g.dnsCache.mu.Lock()
+	e, ok := g.dnsCache.entries.Get(dnsCacheKey{name: "a.example.com.", qtype: dnsmessage.TypeA})
+	if ok {
+		e.received = e.received.Add(-59500 * time.Millisecond)
+	}
+	g.dnsCache.mu.Unlock()
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	if ttl := query(2).Answers[0].Header.TTL; ttl != 1 {
+		t.Fatalf("aged answer with ttl %d, want 1", ttl)
+	}
+}
+
+func TestServeDNSFakeIPExhausted(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	client := create(t, "10.0.0.2/24")
+	link(t, g, client)
+	pool := &nic.FakeIPPool{IPv4: "198.18.0.0/30"} // two addresses
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.ServeDNS(ctx, DNSServerConfig{FakeIP: pool}) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for i, tc := range []struct {
+		name  string
+		rcode dnsmessage.RCode
+	}{{"a.test.", dnsmessage.RCodeSuccess}, {"b.test.", dnsmessage.RCodeSuccess}, {"c.test.", dnsmessage.RCodeServerFailure}, {"a.test.", dnsmessage.RCodeSuccess}} {
+		req, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(i), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(tc.name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := exchangeUDP(t, client, "10.0.0.1:53", req)
+		if resp.Header.RCode != tc.rcode {
+			t.Fatalf("%s: rcode %v, want %v", tc.name, resp.Header.RCode, tc.rcode)
+		}
+	}
+	if m := pool.Mappings(); len(m) != 2 {
+		t.Fatalf("mappings %v", m)
+	}
+}
+
+func TestServeDNSPeers(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	client := create(t, "10.0.0.2/24")
+	link(t, g, client)
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	peers := &nic.VirtualNIC{NIC: a}
+	web := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	peers.AddPeer(nic.Peer{Addr: web, IPv4: "100.64.0.5", IPv6: "fd00::5/64", Meta: url.Values{"name": {"Web"}}})
+	peers.AddPeer(nic.Peer{Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 51820}, IPv4: "100.64.0.6"}) // unnamed
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.ServeDNS(ctx, DNSServerConfig{Zone: "Peers.Internal", Peers: peers}) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	query := func(name string, qtype dnsmessage.Type) dnsmessage.Message {
+		t.Helper()
+		req, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exchangeUDP(t, client, "10.0.0.1:53", req)
+	}
+	answers := func(resp dnsmessage.Message) []string {
+		var s []string
+		for _, rr := range resp.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				s = append(s, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				s = append(s, netip.AddrFrom16(body.AAAA).String())
+			case *dnsmessage.PTRResource:
+				s = append(s, body.PTR.String())
+			}
+		}
+		return s
+	}
+
+	for _, tc := range []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+		want  []string
+	}{
+		{"web.peers.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"100.64.0.5"}},
+		{"WEB.Peers.Internal.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00::5"}},
+		{"5.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"web.peers.internal."}},
+		{reverseAddr(netip.MustParseAddr("fd00::5")), dnsmessage.TypePTR, dnsmessage.RCodeSuccess, []string{"web.peers.internal."}},
+		{"db.peers.internal.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"peers.internal.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil},
+	} {
+		resp := query(tc.name, tc.qtype)
+		if !resp.Header.Authoritative {
+			t.Errorf("%s %v: not authoritative", tc.name, tc.qtype)
+		}
+		if resp.Header.RCode != tc.rcode || !slices.Equal(answers(resp), tc.want) {
+			t.Errorf("%s %v: %v %q, want %v %q", tc.name, tc.qtype, resp.Header.RCode, answers(resp), tc.rcode, tc.want)
+		}
+		if len(tc.want) == 0 && (len(resp.Authorities) != 1 || resp.Authorities[0].Header.Type != dnsmessage.TypeSOA) {
+			t.Errorf("%s %v: negative answer without the soa", tc.name, tc.qtype)
+		}
+	}
+
+	// the zone follows the peers
+	peers.AddPeer(nic.Peer{Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 51820}, IPv4: "100.64.0.7", Meta: url.Values{"name": {"db"}}})
+	if got := answers(query("db.peers.internal.", dnsmessage.TypeA)); !slices.Equal(got, []string{"100.64.0.7"}) {
+		t.Fatalf("added peer: %q", got)
+	}
+	peers.RemovePeer(web)
+	if resp := query("web.peers.internal.", dnsmessage.TypeA); resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("removed peer: %v %q", resp.Header.RCode, answers(resp))
+	}
+	// the reverse name is not the zone's anymore, it is forwarded
+	if resp := query("5.0.64.100.in-addr.arpa.", dnsmessage.TypePTR); resp.Header.Authoritative || len(resp.Answers) != 0 {
+		t.Fatalf("removed peer address: %q", answers(resp))
+	}
+}
@@ -0,0 +1,292 @@
+package gvisor
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// flowMaxInFlight TCP handshakes in progress per nic
+const flowMaxInFlight = 1024
+
+// FlowInfo the original addresses of a flow and the nic it came in on
+type FlowInfo struct {
+	// Network "tcp" or "udp"
+	Network string
+	// Source, Destination as sent by the peer, the destination need not be an
+	// address of the nic
+	Source, Destination netip.AddrPort
+	// NIC the id of the ingress nic, Ingress its Config.Name
+	NIC     tcpip.NICID
+	Ingress string
+}
+
+// FlowHandler handles the flows registered by HandleFlows. the connection is
+// closed when the method returns
+type FlowHandler interface {
+	// HandleTCP serve an established TCP connection
+	HandleTCP(conn net.Conn, flow FlowInfo)
+	// HandleUDP serve a UDP flow, conn is connected to the source of the flow
+	// and takes its next datagrams. it has no idle timeout, use deadlines
+	HandleUDP(conn net.PacketConn, flow FlowInfo)
+}
+
+// FlowHandlerFuncs adapt functions to a FlowHandler, a nil function closes
+// the flow
+type FlowHandlerFuncs struct {
+	TCP func(conn net.Conn, flow FlowInfo)
+	UDP func(conn net.PacketConn, flow FlowInfo)
+}
+
+func (f FlowHandlerFuncs) HandleTCP(conn net.Conn, flow FlowInfo) {
+	if f.TCP != nil {
+		f.TCP(conn, flow)
+	}
+}
+
+func (f FlowHandlerFuncs) HandleUDP(conn net.PacketConn, flow FlowInfo) {
+	if f.UDP != nil {
+		f.UDP(conn, flow)
+	}
+}
+
+// flowTable the nics of a stack taking the flows no endpoint accepts. the
+// transport protocol handlers belong to the stack, they are shared by the nics
+// attached to it
+type flowTable struct {
+	installOnce sync.Once
+	mu          sync.RWMutex
+	nics        map[tcpip.NICID]*nicFlows
+}
+
+// nicFlows the flow handlers and the gateway of a nic
+type nicFlows struct {
+	tcp      *tcp.Forwarder
+	udp      *udp.Forwarder
+	handlers []*flowHandler // most specific first
+	gateway  *gateway
+}
+
+type flowHandler struct {
+	network string // "tcp", "udp" or "" for both
+	dst     netip.Prefix
+	port    uint16 // 0 for any
+	h       FlowHandler
+}
+
+func (h *flowHandler) match(network string, dst netip.AddrPort) bool {
+	return (h.network == "" || h.network == network) && h.dst.Contains(dst.Addr()) && (h.port == 0 || h.port == dst.Port())
+}
+
+// compareFlowHandlers longer prefixes first, then a port before any port and
+// a network before both
+func compareFlowHandlers(a, b *flowHandler) int {
+	if c := cmp.Compare(b.dst.Bits(), a.dst.Bits()); c != 0 {
+		return c
+	}
+	if (a.port == 0) != (b.port == 0) {
+		return prefer(a.port != 0)
+	}
+	if (a.network == "") != (b.network == "") {
+		return prefer(a.network != "")
+	}
+	return 0
+}
+
+func (t *flowTable) install(s *stack.Stack) {
+	t.installOnce.Do(func() {
+		t.nics = make(map[tcpip.NICID]*nicFlows)
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+			f, ok := t.accept(pkt.NICID, "tcp", id)
+			return ok && f.tcp.HandlePacket(id, pkt)
+		})
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+			f, ok := t.accept(pkt.NICID, "udp", id)
+			return ok && f.udp.HandlePacket(id, pkt)
+		})
+	})
+}
+
+// accept whether a handler or the gateway of the nic takes the flow, the
+// stack answers the others as usual
+func (t *flowTable) accept(nicID tcpip.NICID, network string, id stack.TransportEndpointID) (*nicFlows, bool) {
+	h, gw, f := t.route(nicID, network, flowDestination(id))
+	return f, h != nil || gw != nil
+}
+
+// route the handler or else the gateway of a flow
+func (t *flowTable) route(nicID tcpip.NICID, network string, dst netip.AddrPort) (FlowHandler, *gateway, *nicFlows) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f := t.nics[nicID]
+	if f == nil {
+		return nil, nil, nil
+	}
+	for _, h := range f.handlers {
+		if h.match(network, dst) {
+			return h.h, nil, f
+		}
+	}
+	return nil, f.gateway, f
+}
+
+// updateFlows change the flows of the nic, the nic is promiscuous and
+// spoofing while it has handlers or a gateway
+func (g *_Gvisor) updateFlows(fn func(f *nicFlows) error) error {
+	t := g.flows
+	t.install(g.Stack)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g.closed.Load() {
+		return net.ErrClosed
+	}
+	f, had := t.nics[g.nicID]
+	if !had {
+		f = &nicFlows{
+			tcp: tcp.NewForwarder(g.Stack, 0, flowMaxInFlight, g.handleTCPFlow),
+			udp: udp.NewForwarder(g.Stack, g.handleUDPFlow),
+		}
+	}
+	if err := fn(f); err != nil {
+		return err
+	}
+	used := f.gateway != nil || len(f.handlers) > 0
+	switch {
+	case used && !had:
+		if err := g.setPromiscuous(true); err != nil {
+			g.setPromiscuous(false)
+			return err
+		}
+		t.nics[g.nicID] = f
+	case !used && had:
+		delete(t.nics, g.nicID)
+		g.setPromiscuous(false)
+	}
+	return nil
+}
+
+// setPromiscuous accept the packets to any address and send from them
+func (g *_Gvisor) setPromiscuous(enable bool) error {
+	if tcpErr := g.Stack.SetPromiscuousMode(g.nicID, enable); tcpErr != nil {
+		return fmt.Errorf("set promiscuous mode: %s", tcpErr)
+	}
+	if tcpErr := g.Stack.SetSpoofing(g.nicID, enable); tcpErr != nil {
+		return fmt.Errorf("set spoofing: %s", tcpErr)
+	}
+	return nil
+}
+
+// HandleFlows pass the flows to dst and port to h until cancel is called.
+// network is "tcp", "udp" or "" for both, port 0 matches any port. the most
+// specific handler wins, the flows no handler matches go to the gateway of
+// ServeGateway or are refused. flows accepted by Listen and the other
+// endpoints are not affected. the nic is promiscuous while it has handlers,
+// it no longer routes the packets of other destinations to the other nics
+func (g *_Gvisor) HandleFlows(network string, dst netip.Prefix, port uint16, h FlowHandler) (cancel func(), err error) {
+	if err := g.init(); err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "udp", "":
+	default:
+		return nil, fmt.Errorf("handle flows: unsupported network %q", network)
+	}
+	if !dst.IsValid() {
+		return nil, fmt.Errorf("handle flows: invalid destination %s", dst)
+	}
+	fh := &flowHandler{network: network, dst: dst.Masked(), port: port, h: h}
+	err = g.updateFlows(func(f *nicFlows) error {
+		for _, o := range f.handlers {
+			if o.network == fh.network && o.dst == fh.dst && o.port == fh.port {
+				return errors.New("handler exists")
+			}
+		}
+		f.handlers = append(f.handlers, fh)
+		slices.SortStableFunc(f.handlers, compareFlowHandlers)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("handle flows %s %s port %d: %w", cmp.Or(network, "tcp+udp"), fh.dst, port, err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.updateFlows(func(f *nicFlows) error {
+				f.handlers = slices.DeleteFunc(f.handlers, func(o *flowHandler) bool { return o == fh })
+				return nil
+			})
+		})
+	}, nil
+}
+
+func flowDestination(id stack.TransportEndpointID) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+	return netip.AddrPortFrom(addr, id.LocalPort)
+}
+
+func (g *_Gvisor) flowInfo(network string, id stack.TransportEndpointID) FlowInfo {
+	src, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+	return FlowInfo{
+		Network:     network,
+		Source:      netip.AddrPortFrom(src, id.RemotePort),
+		Destination: flowDestination(id),
+		NIC:         g.nicID,
+		Ingress:     g.Config.Name,
+	}
+}
+
+// handleTCPFlow runs on its own goroutine, started by the forwarder
+func (g *_Gvisor) handleTCPFlow(r *tcp.ForwarderRequest) {
+	flow := g.flowInfo("tcp", r.ID())
+	h, gw, _ := g.flows.route(g.nicID, "tcp", flow.Destination)
+	switch {
+	case h != nil:
+		var wq waiter.Queue
+		ep, tcpErr := r.CreateEndpoint(&wq)
+		r.Complete(false)
+		if tcpErr != nil {
+			return
+		}
+		g.Options.setKeepalive(ep)
+		conn := gonet.NewTCPConn(&wq, ep)
+		defer conn.Close()
+		h.HandleTCP(conn, flow)
+	case gw != nil:
+		gw.handleTCP(r, flow)
+	default:
+		r.Complete(true)
+	}
+}
+
+// handleUDPFlow runs on the goroutine delivering the packet, the endpoint is
+// created at once to take the next packets of the flow
+func (g *_Gvisor) handleUDPFlow(r *udp.ForwarderRequest) {
+	flow := g.flowInfo("udp", r.ID())
+	h, gw, _ := g.flows.route(g.nicID, "udp", flow.Destination)
+	switch {
+	case h != nil:
+		var wq waiter.Queue
+		ep, tcpErr := r.CreateEndpoint(&wq)
+		if tcpErr != nil {
+			return
+		}
+		conn := gonet.NewUDPConn(&wq, ep)
+		go func() {
+			defer conn.Close()
+			h.HandleUDP(conn, flow)
+		}()
+	case gw != nil:
+		gw.handleUDP(r, flow)
+	}
+}
@@ -0,0 +1,135 @@
+package gvisor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+// flowEcho a handler answering each flow with its name and FlowInfo
+func flowEcho(name string) FlowHandler {
+	info := func(flow FlowInfo) string {
+		return fmt.Sprintf("%s %s %s %s %d %s", name, flow.Network, flow.Source, flow.Destination, flow.NIC, flow.Ingress)
+	}
+	return FlowHandlerFuncs{
+		TCP: func(conn net.Conn, flow FlowInfo) {
+			io.WriteString(conn, info(flow))
+		},
+		UDP: func(conn net.PacketConn, flow FlowInfo) {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 1500)
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(info(flow)), addr)
+		},
+	}
+}
+
+// flowExchange send to dst from g over network, the answer and the source
+// address of the flow
+func flowExchange(g *_Gvisor, network, dst string) (string, netip.AddrPort, error) {
+	addr := netip.MustParseAddrPort(dst)
+	var c net.Conn
+	var err error
+	if network == "tcp" {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		c, err = g.DialContextTCPAddrPort(ctx, addr)
+	} else {
+		c, err = g.DialUDPAddrPort(netip.AddrPort{}, addr)
+	}
+	if err != nil {
+		return "", netip.AddrPort{}, err
+	}
+	defer c.Close()
+	src := netip.MustParseAddrPort(c.LocalAddr().String())
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if network == "tcp" {
+		b, err := io.ReadAll(c)
+		return string(b), src, err
+	}
+	buf := make([]byte, 1500)
+	for range 50 {
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return "", src, err
+		}
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := c.Read(buf)
+		if err == nil {
+			return string(buf[:n]), src, nil
+		}
+	}
+	return "", src, fmt.Errorf("no answer from %s", dst)
+}
+
+func TestHandleFlows(t *testing.T) {
+	g, err := Create(nic.Config{Name: "flows0", MTU: 1500, IPv4: "10.0.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	client := create(t, "10.0.0.2/24")
+	link(t, g, client)
+
+	handle := func(network, dst string, port uint16, name string) func() {
+		t.Helper()
+		cancel, err := g.HandleFlows(network, netip.MustParsePrefix(dst), port, flowEcho(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cancel)
+		return cancel
+	}
+	cancelAny := handle("", "10.0.0.0/24", 0, "any")
+	cancelPrefix := handle("", "10.0.0.64/26", 0, "prefix")
+	cancelPort := handle("", "10.0.0.64/26", 80, "port")
+	cancelTCP := handle("tcp", "10.0.0.64/26", 80, "tcp")
+
+	if _, err := g.HandleFlows("", netip.MustParsePrefix("10.0.0.64/26"), 80, flowEcho("again")); err == nil {
+		t.Fatal("handler registered twice")
+	}
+	if _, err := g.HandleFlows("icmp", netip.MustParsePrefix("10.0.0.0/24"), 0, flowEcho("icmp")); err == nil {
+		t.Fatal("icmp handler registered")
+	}
+
+	check := func(network, dst, want string) {
+		t.Helper()
+		got, src, err := flowExchange(client, network, dst)
+		if err != nil {
+			t.Fatalf("%s %s: %v", network, dst, err)
+		}
+		info := fmt.Sprintf("%s %s %s %s %d flows0", want, network, src, dst, g.NICID())
+		if got != info {
+			t.Fatalf("%s %s: %q, want %q", network, dst, got, info)
+		}
+	}
+	// the longest prefix first, then a port, then a network
+	check("tcp", "10.0.0.50:80", "any")
+	check("udp", "10.0.0.70:81", "prefix")
+	check("udp", "10.0.0.70:80", "port")
+	check("tcp", "10.0.0.70:80", "tcp")
+
+	// a canceled handler leaves its flows to the next one
+	cancelTCP()
+	cancelTCP()
+	check("tcp", "10.0.0.70:80", "port")
+	cancelPort()
+	check("tcp", "10.0.0.70:80", "prefix")
+	cancelPrefix()
+	check("udp", "10.0.0.70:80", "any")
+	cancelAny()
+	if _, _, err := flowExchange(client, "tcp", "10.0.0.70:80"); err == nil {
+		t.Fatal("flow accepted without handlers")
+	}
+	// the handler can be registered again
+	handle("tcp", "10.0.0.64/26", 80, "tcp")
+	check("tcp", "10.0.0.70:80", "tcp")
+}
@@ -6,13 +6,16 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
 	"sync"
 )
 
 func (g *_Gvisor) Start(ctx context.Context, wg *sync.WaitGroup) (err error) {
 	var forwardJobs []func()
 	var listeners []net.Listener
+	fakePorts := make(map[int64]bool) // tcp4 and tcp6 forwards share the handlers
 	closeEngine := func() {
 		for _, l := range listeners {
 			l.Close()
@@ -37,6 +40,12 @@ func (g *_Gvisor) Start(ctx context.Context, wg *sync.WaitGroup) (err error) {
 			return fmt.Errorf("gvisor listen: %w", err)
 		}
 		listeners = append(listeners, l)
+		if g.FakeIP != nil && strings.HasPrefix(forward.Scheme, "tcp") && !fakePorts[portNum] {
+			fakePorts[portNum] = true
+			if err := g.forwardFakeIP(uint16(portNum)); err != nil {
+				return fmt.Errorf("gvisor forward fake ip: %w", err)
+			}
+		}
 		slog.Info("[gVisor] Forwarding", "pg_addr", l.Addr(), "to_addr", forward)
 		forwardJobs = append(forwardJobs, func() {
 			for {
@@ -66,6 +75,39 @@ func (g *_Gvisor) Start(ctx context.Context, wg *sync.WaitGroup) (err error) {
 	return nil
 }
 
+// forwardFakeIP dial the mapped domain of the connections to the fake
+// addresses on port, those to unmapped addresses are closed. the handlers
+// are removed with the nic
+func (g *_Gvisor) forwardFakeIP(port uint16) error {
+	h := FlowHandlerFuncs{TCP: func(conn net.Conn, flow FlowInfo) {
+		domain, ok := g.FakeIP.Domain(flow.Destination.Addr())
+		if !ok {
+			return
+		}
+		target := net.JoinHostPort(domain, strconv.Itoa(int(port)))
+		slog.Info("[gVisor] AcceptConn", "pg_addr", flow.Destination, "from", flow.Source, "forward_to", target)
+		c1, err := net.Dial("tcp", target)
+		if err != nil {
+			slog.Error("[gVisor] Dial backend", "backend", target, "err", err)
+			return
+		}
+		relayStream(conn, c1)
+	}}
+	for _, s := range []string{g.FakeIP.IPv4, g.FakeIP.IPv6} {
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		if _, err := g.HandleFlows("tcp", prefix, port, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var bufferPool = &sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 32*1024) // 32KB buffer
@@ -0,0 +1,99 @@
+package gvisor
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+// hostServer answer every connection on addr of the host with name
+func hostServer(t *testing.T, addr, name string) int {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("host listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, name)
+			c.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestForwardFakeIP(t *testing.T) {
+	port := hostServer(t, "127.0.0.1:0", "localhost")
+	hostServer(t, net.JoinHostPort("127.0.0.2", strconv.Itoa(port)), "backend")
+
+	g, err := Create(nic.Config{MTU: 1500, IPv4: "10.0.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &nic.FakeIPPool{IPv4: "198.18.0.0/15"}
+	fake, err := pool.Allocate("LocalHost.", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.FakeIP = pool
+	g.Forwards = []*url.URL{{Scheme: "tcp", Host: net.JoinHostPort("127.0.0.2", strconv.Itoa(port))}}
+	client := create(t, "10.0.0.2/24")
+	link(t, g, client)
+	if err := client.AddRoute(netip.MustParsePrefix("198.18.0.0/15"), netip.MustParseAddr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := g.Start(ctx, &wg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// the relay of the forwards ends with the client, the answer is read
+	// without waiting for its end
+	read := func(dst netip.Addr, n int) (string, error) {
+		c, err := client.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(dst, uint16(port)))
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, n)
+		n, err = io.ReadFull(c, b)
+		return string(b[:n]), err
+	}
+	// the nic address goes to the host of the forward, a fake address to
+	// its domain
+	for _, tc := range []struct {
+		dst  netip.Addr
+		want string
+	}{{netip.MustParseAddr("10.0.0.1"), "backend"}, {fake, "localhost"}} {
+		got, err := read(tc.dst, len(tc.want))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.dst, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s forwarded to %q, want %q", tc.dst, got, tc.want)
+		}
+	}
+	// an unmapped fake address is closed
+	if got, err := read(netip.MustParseAddr("198.18.0.200"), 1); err == nil {
+		t.Fatalf("unmapped fake address forwarded to %q", got)
+	}
+}
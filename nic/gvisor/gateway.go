@@ -0,0 +1,241 @@
+package gvisor
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	defaultGatewayDialTimeout = 10 * time.Second
+	defaultGatewayUDPTimeout  = 60 * time.Second
+)
+
+// GatewayConfig configures the gateway mode of ServeGateway
+type GatewayConfig struct {
+	// Dial open the host side connection of a flow, network is "tcp" or
+	// "udp". default a net.Dialer on the host network
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// FakeIP when set, the flows to its addresses are dialed by the mapped
+	// domain, the flows to unmapped addresses are refused
+	FakeIP *nic.FakeIPPool
+	// DialTimeout of the host side connections, default 10s
+	DialTimeout time.Duration
+	// UDPTimeout a UDP flow is closed after it is idle this long, default 60s
+	UDPTimeout time.Duration
+}
+
+// ServeGateway accept the TCP and UDP flows to any destination until ctx is
+// done, each flow is relayed to a host side connection to its destination.
+// the nic is made promiscuous and spoofing, and default routes are added
+// when it has none, so a TUN bridged to the nic egresses through the host.
+// the routes of the stack are shared by its nics, so no default route is
+// added when the stack has other nics, they would send their traffic to the
+// gateway. the flows accepted by Listen, the other endpoints and the
+// handlers of HandleFlows are not affected
+func (g *_Gvisor) ServeGateway(ctx context.Context, cfg GatewayConfig) error {
+	if err := g.init(); err != nil {
+		return err
+	}
+	if cfg.DialTimeout < 0 || cfg.UDPTimeout < 0 {
+		return errors.New("gateway: negative timeout")
+	}
+	gw := &gateway{g: g, ctx: ctx, cfg: cfg}
+	if gw.cfg.Dial == nil {
+		var d net.Dialer
+		gw.cfg.Dial = d.DialContext
+	}
+	gw.cfg.DialTimeout = cmp.Or(cfg.DialTimeout, defaultGatewayDialTimeout)
+	gw.cfg.UDPTimeout = cmp.Or(cfg.UDPTimeout, defaultGatewayUDPTimeout)
+
+	err := g.updateFlows(func(f *nicFlows) error {
+		if f.gateway != nil {
+			return errors.New("nic is already a gateway")
+		}
+		f.gateway = gw
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	defer g.updateFlows(func(f *nicFlows) error {
+		f.gateway = nil
+		return nil
+	})
+	if len(g.Stack.NICInfo()) == 1 {
+		for _, dst := range []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")} {
+			if g.AddRoute(dst, netip.Addr{}) == nil {
+				defer g.RemoveRoute(dst, netip.Addr{})
+			}
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// gateway relays the flows of a nic to the host network
+type gateway struct {
+	g   *_Gvisor
+	ctx context.Context
+	cfg GatewayConfig
+}
+
+// target the address to dial for the destination of a flow, by the domain
+// of a fake address
+func (gw *gateway) target(dst netip.AddrPort) (string, bool) {
+	addr, port := dst.Addr(), strconv.Itoa(int(dst.Port()))
+	if gw.cfg.FakeIP != nil && gw.cfg.FakeIP.Contains(addr) {
+		domain, ok := gw.cfg.FakeIP.Domain(addr)
+		return net.JoinHostPort(domain, port), ok
+	}
+	// the flows to the nic itself have no host side. CheckLocalAddress takes
+	// any address in promiscuous mode
+	for _, prefix := range gw.g.Addresses() {
+		if prefix.Addr() == addr {
+			return "", false
+		}
+	}
+	return net.JoinHostPort(addr.String(), port), true
+}
+
+func (gw *gateway) dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(gw.ctx, gw.cfg.DialTimeout)
+	defer cancel()
+	return gw.cfg.Dial(ctx, network, address)
+}
+
+// handleTCP dial the destination before completing the handshake, so a
+// refused or unreachable destination resets the flow
+func (gw *gateway) handleTCP(r *tcp.ForwarderRequest, flow FlowInfo) {
+	address, ok := gw.target(flow.Destination)
+	if !ok {
+		r.Complete(true)
+		return
+	}
+	remote, err := gw.dial("tcp", address)
+	if err != nil {
+		slog.Debug("[gVisor] gateway dial", "network", "tcp", "address", address, "err", err)
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	r.Complete(false)
+	if tcpErr != nil {
+		remote.Close()
+		return
+	}
+	gw.g.Options.setKeepalive(ep)
+	local := gonet.NewTCPConn(&wq, ep)
+	stop := context.AfterFunc(gw.ctx, func() {
+		local.Close()
+		remote.Close()
+	})
+	defer stop()
+	relayStream(local, remote)
+}
+
+// relayStream copy both ways until both sides finished sending, the end of
+// one direction is passed on with a half close
+func relayStream(c1, c2 net.Conn) {
+	defer c1.Close()
+	defer c2.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copy := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf := bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		_, err := io.CopyBuffer(dst, src, buf)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		// an error or no half close, stop the other direction too
+		c1.Close()
+		c2.Close()
+	}
+	go copy(c1, c2)
+	go copy(c2, c1)
+	wg.Wait()
+}
+
+// handleUDP create the endpoint at once, the dial runs on its own goroutine
+func (gw *gateway) handleUDP(r *udp.ForwarderRequest, flow FlowInfo) {
+	address, ok := gw.target(flow.Destination)
+	if !ok {
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return
+	}
+	local := gonet.NewUDPConn(&wq, ep)
+	go func() {
+		remote, err := gw.dial("udp", address)
+		if err != nil {
+			slog.Debug("[gVisor] gateway dial", "network", "udp", "address", address, "err", err)
+			local.Close()
+			return
+		}
+		stop := context.AfterFunc(gw.ctx, func() {
+			local.Close()
+			remote.Close()
+		})
+		defer stop()
+		relayPackets(local, remote, gw.cfg.UDPTimeout)
+	}()
+}
+
+// relayPackets copy datagrams both ways until neither side sent one for
+// timeout
+func relayPackets(c1, c2 net.Conn, timeout time.Duration) {
+	defer c1.Close()
+	defer c2.Close()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copy := func(dst, src net.Conn) {
+		defer wg.Done()
+		defer dst.Close() // stop the other direction
+		buf := make([]byte, 65535)
+		for {
+			src.SetReadDeadline(time.Unix(0, lastActive.Load()).Add(timeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, lastActive.Load())) < timeout {
+					continue
+				}
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	go copy(c1, c2)
+	go copy(c2, c1)
+	wg.Wait()
+}
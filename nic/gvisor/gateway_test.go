@@ -0,0 +1,142 @@
+package gvisor
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+// serveGateway run ServeGateway on g until the test ends
+func serveGateway(t *testing.T, g *_Gvisor, cfg GatewayConfig) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.ServeGateway(ctx, cfg) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("gateway: %v", err)
+		}
+	})
+}
+
+func TestGatewayHalfClose(t *testing.T) {
+	gw := create(t, "10.0.0.1/24")
+	client := create(t, "10.0.0.2/24")
+	link(t, gw, client)
+	if err := client.AddRoute(netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host side answers once the client finished sending
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		c.Write(append([]byte("echo "), b...))
+	}()
+	dialed := make(chan string, 1)
+	serveGateway(t, gw, GatewayConfig{Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var c net.Conn
+	for c == nil {
+		if c, err = client.DialContextTCPAddrPort(ctx, netip.MustParseAddrPort("192.0.2.1:80")); err != nil && ctx.Err() != nil {
+			t.Fatal(err)
+		}
+	}
+	defer c.Close()
+	if got := <-dialed; got != "192.0.2.1:80" {
+		t.Fatalf("dialed %s", got)
+	}
+	io.WriteString(c, "ping")
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "echo ping" {
+		t.Fatalf("read %q", b)
+	}
+}
+
+// servingContext a context telling when the gateway is set up and waits
+// for its end
+type servingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func (c *servingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	serveGateway(t, g, GatewayConfig{})
+	hasDefault := func() bool {
+		for _, r := range g.Routes() {
+			if r.Destination.Bits() == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(5 * time.Second); !hasDefault(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no default route on a single nic stack")
+		}
+	}
+
+	// the default routes would take the traffic of the other nics
+	lan := create(t, "10.0.1.1/24")
+	wan, err := lan.Attach(nic.Config{MTU: 1500, IPv4: "10.0.2.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wan.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	serving := &servingContext{Context: ctx, waiting: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- lan.ServeGateway(serving, GatewayConfig{}) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("gateway: %v", err)
+		}
+	})
+	select {
+	case <-serving.waiting:
+	case err := <-done:
+		t.Fatalf("gateway: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gateway not serving")
+	}
+	for _, r := range lan.Routes() {
+		if r.Destination.Bits() == 0 {
+			t.Fatalf("default route %s on a multi nic stack", r)
+		}
+	}
+}
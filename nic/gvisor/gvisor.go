@@ -8,106 +8,129 @@ import (
 	"net"
 	"net/netip"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	nic "github.com/darkit/waiter"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
-	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
-	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
-	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
-var _ nic.NIC = (*_Gvisor)(nil)
+var (
+	_ nic.BatchNIC    = (*_Gvisor)(nil)
+	_ nic.DeadlineNIC = (*_Gvisor)(nil)
+)
 
 type _Gvisor struct {
-	Stack  *stack.Stack
-	Config nic.Config
+	Stack   *stack.Stack
+	Config  nic.Config
+	Options Options
 
 	initOnce  sync.Once
 	closeOnce sync.Once
 
 	ep    *channel.Endpoint
 	nicID tcpip.NICID
-
-	addr4 tcpip.Address
-	addr6 tcpip.Address
-
-	dnsServers []netip.Addr
-	Forwards   []*url.URL
-
-	hasV4, hasV6 bool
+	pool  *nic.PacketPool
+
+	readNotify   notifier
+	readDeadline nic.Deadline
+	closed       atomic.Bool
+	initErr      error
+
+	resolver atomic.Pointer[resolverConf]
+	rotate   atomic.Uint32
+	dnsCache dnsCache
+	flows    *flowTable // shared by the nics of the stack
+	Forwards []*url.URL
+	// FakeIP when set, the TCP forwards also take the connections to its
+	// addresses on their port and dial the mapped domain instead of their host
+	FakeIP *nic.FakeIPPool
 }
 
+// Create create a gVisor nic with the default stack options
 func Create(cfg nic.Config) (*_Gvisor, error) {
-	s := stack.New(stack.Options{
-		NetworkProtocols: []stack.NetworkProtocolFactory{
-			ipv4.NewProtocol,
-			ipv6.NewProtocol,
-		},
-		TransportProtocols: []stack.TransportProtocolFactory{
-			tcp.NewProtocol,
-			udp.NewProtocol,
-			icmp.NewProtocol4,
-			icmp.NewProtocol6,
-		},
-	})
+	return CreateWithOptions(cfg, Options{})
+}
 
-	tcpRecoveryOpt := tcpip.TCPRecovery(0)
-	s.SetTransportProtocolOption(tcp.ProtocolNumber, &tcpRecoveryOpt)
+// Attach create another nic on the stack of g with its own addresses and
+// routes, it shares the stack options. see SetForwarding to route packets
+// between the nics of a stack
+func (g *_Gvisor) Attach(cfg nic.Config) (*_Gvisor, error) {
+	a := &_Gvisor{Config: cfg, Options: g.Options, Stack: g.Stack, flows: g.flows}
+	if err := a.init(); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("attach nic: %w", err)
+	}
+	return a, nil
+}
+
+// SetForwarding enable or disable ip forwarding between all nics of the stack
+func (g *_Gvisor) SetForwarding(enable bool) error {
+	for _, pn := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		if !g.Stack.CheckNetworkProtocol(pn) {
+			continue
+		}
+		if err := g.Stack.SetForwardingDefaultAndAllNICs(pn, enable); err != nil {
+			return fmt.Errorf("set forwarding: %s", err)
+		}
+	}
+	return nil
+}
 
-	return &_Gvisor{Config: cfg, Stack: s}, nil
+// NICID the id of the nic in the stack
+func (g *_Gvisor) NICID() tcpip.NICID {
+	g.init()
+	return g.nicID
 }
 
-func (g *_Gvisor) init() {
+func (g *_Gvisor) init() error {
 	g.initOnce.Do(func() {
 		g.nicID = g.Stack.NextNICID()
-		g.ep = channel.New(512, uint32(cmp.Or(g.Config.MTU, 1500)), "00:ab:00:00:00:00")
-		g.Stack.CreateNIC(g.nicID, g.ep)
+		g.pool = nic.NewPacketPool(cmp.Or(g.Config.MTU, 1500))
+		linkAddr, _ := net.ParseMAC(cmp.Or(g.Options.LinkAddress, defaultLinkAddress))
+		g.ep = channel.New(cmp.Or(g.Options.QueueSize, defaultQueueSize), uint32(cmp.Or(g.Config.MTU, 1500)), tcpip.LinkAddress(linkAddr))
+		g.readNotify = make(notifier, 1)
+		g.ep.AddNotify(g.readNotify)
+		if err := g.Stack.CreateNIC(g.nicID, g.ep); err != nil {
+			g.initErr = fmt.Errorf("create nic: %s", err)
+			return
+		}
 
-		if g.Config.IPv4 != "" {
-			ip, ipnet, err := net.ParseCIDR(g.Config.IPv4)
-			if err != nil {
-				panic(fmt.Errorf("parse ipv4: %s: %w", g.Config.IPv4, err))
+		for _, cidr := range []struct {
+			s  string
+			v6 bool
+		}{{g.Config.IPv4, false}, {g.Config.IPv6, true}} {
+			if cidr.s == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(cidr.s)
+			if err == nil && prefix.Addr().Is6() != cidr.v6 {
+				err = errors.New("wrong address family")
+			}
+			if err == nil {
+				err = g.addAddress(prefix)
 			}
-			ones, _ := ipnet.Mask.Size()
-			g.addr4 = tcpip.AddrFrom4([4]byte(ip.To4()))
-
-			g.Stack.AddProtocolAddress(g.nicID, tcpip.ProtocolAddress{
-				Protocol:          ipv4.ProtocolNumber,
-				AddressWithPrefix: tcpip.AddressWithPrefix{Address: g.addr4, PrefixLen: ones},
-			}, stack.AddressProperties{})
-
-			subnet, err := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte(ipnet.IP.To4())), tcpip.MaskFromBytes(ipnet.Mask))
-			g.Stack.AddRoute(tcpip.Route{Destination: subnet, NIC: g.nicID})
-		}
-		if g.Config.IPv6 != "" {
-			ip, ipnet, err := net.ParseCIDR(g.Config.IPv6)
 			if err != nil {
-				panic(fmt.Errorf("parse ipv6: %s: %w", g.Config.IPv6, err))
+				g.initErr = fmt.Errorf("config address %s: %w", cidr.s, err)
+				return
 			}
-			ones, _ := ipnet.Mask.Size()
-			g.addr6 = tcpip.AddrFrom16([16]byte(ip))
-
-			g.Stack.AddProtocolAddress(g.nicID, tcpip.ProtocolAddress{
-				Protocol:          ipv6.ProtocolNumber,
-				AddressWithPrefix: tcpip.AddressWithPrefix{Address: g.addr6, PrefixLen: ones},
-			}, stack.AddressProperties{})
-
-			subnet, err := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte(ipnet.IP)), tcpip.MaskFromBytes(ipnet.Mask))
-			g.Stack.AddRoute(tcpip.Route{Destination: subnet, NIC: g.nicID})
 		}
 	})
+	return g.initErr
 }
 
 func (g *_Gvisor) Write(p *nic.Packet) error {
-	g.init()
+	if err := g.init(); err != nil {
+		return err
+	}
 	var ipVer tcpip.NetworkProtocolNumber
 	if p.Ver() == 4 {
 		ipVer = ipv4.ProtocolNumber
@@ -118,61 +141,137 @@ func (g *_Gvisor) Write(p *nic.Packet) error {
 	return nil
 }
 
+func (g *_Gvisor) WriteBatch(pkts []*nic.Packet) (int, error) {
+	for i, p := range pkts {
+		if err := g.Write(p); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
 func (g *_Gvisor) Read() (*nic.Packet, error) {
-	g.init()
-	buf := g.ep.ReadContext(context.TODO())
-	if buf == nil {
-		return nil, net.ErrClosed
+	return g.ReadContext(context.Background())
+}
+
+func (g *_Gvisor) ReadContext(ctx context.Context) (*nic.Packet, error) {
+	if err := g.init(); err != nil {
+		return nil, err
 	}
+	for {
+		if buf := g.ep.Read(); buf != nil {
+			if g.ep.NumQueued() > 0 {
+				g.readNotify.WriteNotify() // wake up other readers
+			}
+			return g.toPacket(buf), nil
+		}
+		if g.closed.Load() {
+			g.readNotify.WriteNotify() // wake up other readers
+			return nil, net.ErrClosed
+		}
+		select {
+		case <-g.readNotify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-g.readDeadline.Done():
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (g *_Gvisor) SetReadDeadline(t time.Time) error {
+	g.readDeadline.Set(t)
+	return nil
+}
+
+func (g *_Gvisor) ReadDeadline() time.Time {
+	return g.readDeadline.Time()
+}
+
+func (g *_Gvisor) ReadBatch(pkts []*nic.Packet) (int, error) {
+	return nic.FillBatch(pkts, g.Read, func() *nic.Packet {
+		if buf := g.ep.Read(); buf != nil {
+			return g.toPacket(buf)
+		}
+		return nil
+	})
+}
+
+// notifier wakes up readers when the stack writes a packet to the channel endpoint
+type notifier chan struct{}
+
+func (n notifier) WriteNotify() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+func (g *_Gvisor) toPacket(buf *stack.PacketBuffer) *nic.Packet {
 	defer buf.DecRef()
-	pkt := nic.IPPacketPool.Get()
+	pkt := g.pool.GetSize(buf.Size())
 	pkt.Write(buf.ToView().AsSlice())
-	return pkt, nil
+	pkt.Meta().Ingress = g.Config.Name
+	pkt.Meta().Time = time.Now()
+	return pkt
+}
+
+// Pool the packet pool sized for the nic MTU, read packets come from it
+func (g *_Gvisor) Pool() *nic.PacketPool {
+	g.init()
+	return g.pool
 }
 
 func (g *_Gvisor) Close() error {
 	g.closeOnce.Do(func() {
-		if g.Stack != nil {
-			if g.addr4.Len() > 0 {
-				g.Stack.RemoveAddress(g.nicID, g.addr4)
-			}
-			if g.addr6.Len() > 0 {
-				g.Stack.RemoveAddress(g.nicID, g.addr6)
-			}
-			g.Stack.RemoveRoutes(func(r tcpip.Route) bool {
-				return r.NIC == g.nicID
-			})
-		}
+		g.closed.Store(true)
+		// a nic closed before its first use is never created
+		g.initOnce.Do(func() {
+			g.initErr = net.ErrClosed
+		})
 		if g.ep != nil {
+			// the handlers and the gateway of the nic stop taking flows,
+			// updateFlows sees closed once it holds the lock
+			g.flows.mu.Lock()
+			delete(g.flows.nics, g.nicID)
+			g.flows.mu.Unlock()
+			g.Stack.RemoveNIC(g.nicID) // removes the addresses and routes too
 			g.ep.Close()
+			g.readNotify.WriteNotify()
+		}
+		if conf := g.resolver.Load(); conf != nil {
+			conf.upstreams.retire()
 		}
 	})
 	return nil
 }
 
 func (g *_Gvisor) Listen(network string, port uint16) (l net.Listener, err error) {
-	g.init()
+	if err := g.init(); err != nil {
+		return nil, err
+	}
 	if !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
 		return nil, errors.New("only tcp/udp is supported")
 	}
+	addr4, addr6 := g.mainAddress(ipv4.ProtocolNumber), g.mainAddress(ipv6.ProtocolNumber)
 
 	if network == "tcp4" {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr4, Port: port}
-		return gonet.ListenTCP(g.Stack, addr, ipv4.ProtocolNumber)
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr4, Port: port}
+		return g.listenTCP(addr, ipv4.ProtocolNumber)
 	}
 
 	if network == "tcp6" {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr6, Port: port}
-		return gonet.ListenTCP(g.Stack, addr, ipv6.ProtocolNumber)
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr6, Port: port}
+		return g.listenTCP(addr, ipv6.ProtocolNumber)
 	}
 
 	if network == "udp4" {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr4, Port: port}
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr4, Port: port}
 		return &udpListener{s: g.Stack, addr: addr}, nil
 	}
 
 	if network == "udp6" {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr6, Port: port}
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr6, Port: port}
 		return &udpListener{s: g.Stack, addr: addr}, nil
 	}
 
@@ -186,28 +285,28 @@ func (g *_Gvisor) Listen(network string, port uint16) (l net.Listener, err error
 	}()
 
 	if network == "udp" {
-		if g.addr4.Len() > 0 {
-			addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr4, Port: port}
+		if addr4.Len() > 0 {
+			addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr4, Port: port}
 			listeners = append(listeners, &udpListener{s: g.Stack, addr: addr})
 		}
-		if g.addr6.Len() > 0 {
-			addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr6, Port: port}
+		if addr6.Len() > 0 {
+			addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr6, Port: port}
 			listeners = append(listeners, &udpListener{s: g.Stack, addr: addr})
 		}
 		return &combinedListeners{listeners: listeners}, nil
 	}
 
-	if g.addr4.Len() > 0 {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr4, Port: port}
-		l, err := gonet.ListenTCP(g.Stack, addr, ipv4.ProtocolNumber)
+	if addr4.Len() > 0 {
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr4, Port: port}
+		l, err := g.listenTCP(addr, ipv4.ProtocolNumber)
 		if err != nil {
 			return nil, err
 		}
 		listeners = append(listeners, l)
 	}
-	if g.addr6.Len() > 0 {
-		addr := tcpip.FullAddress{NIC: g.nicID, Addr: g.addr6, Port: port}
-		l, err := gonet.ListenTCP(g.Stack, addr, ipv6.ProtocolNumber)
+	if addr6.Len() > 0 {
+		addr := tcpip.FullAddress{NIC: g.nicID, Addr: addr6, Port: port}
+		l, err := g.listenTCP(addr, ipv6.ProtocolNumber)
 		if err != nil {
 			return nil, err
 		}
@@ -244,14 +343,17 @@ func (l *combinedListeners) accept(listener net.Listener) {
 		c, err := listener.Accept()
 		if err != nil {
 			select {
+			case l.errChan <- err:
 			case <-l.closeChan:
-				return
-			default:
 			}
-			l.errChan <- err
 			return
 		}
-		l.connChan <- c
+		select {
+		case l.connChan <- c:
+		case <-l.closeChan:
+			c.Close()
+			return
+		}
 	}
 }
 
@@ -267,17 +369,11 @@ func (l *combinedListeners) Accept() (net.Conn, error) {
 	}
 }
 
+// Close init first, a concurrent Accept then waits on the same closeChan
 func (l *combinedListeners) Close() error {
+	l.init()
 	l.closeOnce.Do(func() {
-		if l.closeChan != nil {
-			close(l.closeChan)
-		}
-		if l.connChan != nil {
-			close(l.connChan)
-		}
-		if l.errChan != nil {
-			close(l.errChan)
-		}
+		close(l.closeChan)
 		for _, listener := range l.listeners {
 			listener.Close()
 		}
@@ -0,0 +1,194 @@
+package gvisor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+// link connect two nics with a pipe until the test ends
+func link(t *testing.T, x, y nic.NIC) {
+	t.Helper()
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for _, br := range []*nic.Bridge{{A: x, B: a}, {A: y, B: b}} {
+		go func() {
+			br.Run(ctx)
+			done <- struct{}{}
+		}()
+	}
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+		a.Close()
+	})
+}
+
+func create(t *testing.T, cidr string) *_Gvisor {
+	t.Helper()
+	g, err := Create(nic.Config{MTU: 1500, IPv4: cidr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+// serve answer every connection with its remote address
+func serve(t *testing.T, g *_Gvisor) {
+	t.Helper()
+	l, err := g.Listen("tcp4", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, c.RemoteAddr().(*net.TCPAddr).IP.String())
+			c.Close()
+		}
+	}()
+}
+
+// remoteAddr dial dst from g and read the address the server saw
+func remoteAddr(g *_Gvisor, dst string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := g.DialContextTCPAddrPort(ctx, netip.MustParseAddrPort(dst))
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	b, err := io.ReadAll(c)
+	return string(b), err
+}
+
+// TestMultiNIC a router stack with two nics between two host stacks
+func TestMultiNIC(t *testing.T) {
+	hostA := create(t, "10.0.1.1/24")
+	hostB := create(t, "10.0.2.1/24")
+	lan := create(t, "10.0.1.254/24")
+	wan, err := lan.Attach(nic.Config{MTU: 1500, IPv4: "10.0.2.254/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wan.Close() })
+	if lan.NICID() == wan.NICID() {
+		t.Fatalf("attached nic shares id %d", wan.NICID())
+	}
+	link(t, hostA, lan)
+	link(t, hostB, wan)
+	serve(t, hostA)
+	serve(t, hostB)
+
+	// each nic of the router dials from its own address
+	for _, tc := range []struct {
+		g        *_Gvisor
+		dst, src string
+	}{{lan, "10.0.1.1:8080", "10.0.1.254"}, {wan, "10.0.2.1:8080", "10.0.2.254"}} {
+		got, err := remoteAddr(tc.g, tc.dst, 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial %s from nic %d: %v", tc.dst, tc.g.NICID(), err)
+		}
+		if got != tc.src {
+			t.Fatalf("dial %s from nic %d: server saw %s, want %s", tc.dst, tc.g.NICID(), got, tc.src)
+		}
+	}
+	// a dial is bound to the nic, the other subnet is not on-link for it
+	if _, err := remoteAddr(wan, "10.0.1.1:8080", 500*time.Millisecond); err == nil {
+		t.Fatal("wan nic reached the lan subnet")
+	}
+
+	// forwarding routes the hosts through the router
+	if err := hostA.AddRoute(netip.MustParsePrefix("10.0.2.0/24"), netip.MustParseAddr("10.0.1.254")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hostB.AddRoute(netip.MustParsePrefix("10.0.1.0/24"), netip.MustParseAddr("10.0.2.254")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteAddr(hostA, "10.0.2.1:8080", 500*time.Millisecond); err == nil {
+		t.Fatal("forwarded before SetForwarding")
+	}
+	if err := lan.SetForwarding(true); err != nil {
+		t.Fatal(err)
+	}
+	got, err := remoteAddr(hostA, "10.0.2.1:8080", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.0.1.1" {
+		t.Fatalf("forwarded connection from %s", got)
+	}
+}
+
+func TestCloseBeforeInit(t *testing.T) {
+	g, err := Create(nic.Config{MTU: 1500, IPv4: "10.0.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	if _, err := g.Listen("tcp4", 80); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listen after close: %v", err)
+	}
+	if _, err := g.Read(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read after close: %v", err)
+	}
+	if nics := g.Stack.NICInfo(); len(nics) != 0 {
+		t.Fatalf("closed nic created %d nics", len(nics))
+	}
+}
+
+func TestMappedAddress(t *testing.T) {
+	g := create(t, "10.0.0.1/24")
+	if err := g.AddAddress(netip.MustParsePrefix("::ffff:10.0.1.1/120")); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(g.Addresses(), netip.MustParsePrefix("10.0.1.1/24")) {
+		t.Fatalf("mapped address added as %v", g.Addresses())
+	}
+	if err := g.RemoveAddress(netip.MustParseAddr("::ffff:10.0.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range g.Routes() {
+		if r.Destination == netip.MustParsePrefix("10.0.1.0/24") {
+			t.Fatalf("route %s left after removing the address", r)
+		}
+	}
+}
+
+func TestCloseRemovesFlows(t *testing.T) {
+	lan := create(t, "10.0.1.1/24")
+	wan, err := lan.Attach(nic.Config{MTU: 1500, IPv4: "10.0.2.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := netip.MustParsePrefix("0.0.0.0/0")
+	if _, err := wan.HandleFlows("", all, 0, FlowHandlerFuncs{}); err != nil {
+		t.Fatal(err)
+	}
+	wan.Close()
+	lan.flows.mu.RLock()
+	_, ok := lan.flows.nics[wan.NICID()]
+	lan.flows.mu.RUnlock()
+	if ok {
+		t.Fatal("closed nic left in the flow table")
+	}
+	if _, err := wan.HandleFlows("", all, 0, FlowHandlerFuncs{}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("handle flows after close: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package gvisor
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCNAMEChain max aliases followed for one query
+const maxCNAMEChain = 8
+
+var (
+	errMalformedDNSRecords = errors.New("DNS response contained records which contain invalid names")
+	errCNAMELoop           = errors.New("too many CNAME redirects")
+)
+
+// LookupContextCNAME get the canonical name of host after following its CNAME
+// chain, host itself when it has no alias
+func (g *_Gvisor) LookupContextCNAME(ctx context.Context, host string) (string, error) {
+	if _, ok := g.resolverConf().lookupHosts(host); ok {
+		return absDomainName(host), nil
+	}
+	_, cname, err := g.lookup(ctx, host, dnsmessage.TypeA)
+	if err != nil {
+		return "", err
+	}
+	if !validName(cname) {
+		return "", &net.DNSError{Err: errMalformedDNSRecords.Error(), Name: host}
+	}
+	return cname, nil
+}
+
+func (g *_Gvisor) LookupCNAME(host string) (string, error) {
+	return g.LookupContextCNAME(context.Background(), host)
+}
+
+// LookupContextSRV query the SRV records of _service._proto.name, or of name
+// when service and proto are empty. the records are sorted by priority and
+// randomized by weight
+func (g *_Gvisor) LookupContextSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	rrs, cname, err := g.lookup(ctx, target, dnsmessage.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+	var srvs []*net.SRV
+	malformed := false
+	for _, rr := range rrs {
+		srv := rr.Body.(*dnsmessage.SRVResource)
+		if !validName(srv.Target.String()) {
+			malformed = true
+			continue
+		}
+		srvs = append(srvs, &net.SRV{Target: srv.Target.String(), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+	}
+	sortSRV(srvs)
+	if malformed {
+		return cname, srvs, &net.DNSError{Err: errMalformedDNSRecords.Error(), Name: target}
+	}
+	return cname, srvs, nil
+}
+
+func (g *_Gvisor) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return g.LookupContextSRV(context.Background(), service, proto, name)
+}
+
+// LookupContextMX query the MX records of name sorted by preference
+func (g *_Gvisor) LookupContextMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rrs, _, err := g.lookup(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	malformed := false
+	for _, rr := range rrs {
+		mx := rr.Body.(*dnsmessage.MXResource)
+		if !validName(mx.MX.String()) {
+			malformed = true
+			continue
+		}
+		mxs = append(mxs, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+	}
+	rand.Shuffle(len(mxs), func(i, j int) { mxs[i], mxs[j] = mxs[j], mxs[i] })
+	slices.SortStableFunc(mxs, func(a, b *net.MX) int { return cmp.Compare(a.Pref, b.Pref) })
+	if malformed {
+		return mxs, &net.DNSError{Err: errMalformedDNSRecords.Error(), Name: name}
+	}
+	return mxs, nil
+}
+
+func (g *_Gvisor) LookupMX(name string) ([]*net.MX, error) {
+	return g.LookupContextMX(context.Background(), name)
+}
+
+// LookupContextNS query the NS records of name
+func (g *_Gvisor) LookupContextNS(ctx context.Context, name string) ([]*net.NS, error) {
+	rrs, _, err := g.lookup(ctx, name, dnsmessage.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	var nss []*net.NS
+	malformed := false
+	for _, rr := range rrs {
+		ns := rr.Body.(*dnsmessage.NSResource)
+		if !validName(ns.NS.String()) {
+			malformed = true
+			continue
+		}
+		nss = append(nss, &net.NS{Host: ns.NS.String()})
+	}
+	if malformed {
+		return nss, &net.DNSError{Err: errMalformedDNSRecords.Error(), Name: name}
+	}
+	return nss, nil
+}
+
+func (g *_Gvisor) LookupNS(name string) ([]*net.NS, error) {
+	return g.LookupContextNS(context.Background(), name)
+}
+
+// LookupContextTXT query the TXT records of name, the strings of a record
+// are joined
+func (g *_Gvisor) LookupContextTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, _, err := g.lookup(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	txts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		txts = append(txts, strings.Join(rr.Body.(*dnsmessage.TXTResource).TXT, ""))
+	}
+	return txts, nil
+}
+
+func (g *_Gvisor) LookupTXT(name string) ([]string, error) {
+	return g.LookupContextTXT(context.Background(), name)
+}
+
+// LookupContextAddr reverse lookup addr, the static hosts table is consulted
+// before the servers
+func (g *_Gvisor) LookupContextAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	ip = ip.Unmap().WithZone("")
+	conf := g.resolverConf()
+	var names []string
+	for name, addrs := range conf.hosts {
+		if slices.Contains(addrs, ip) {
+			names = append(names, name+".")
+		}
+	}
+	if len(names) > 0 {
+		slices.Sort(names)
+		return names, nil
+	}
+	rrs, _, err := g.resolve(ctx, conf, reverseAddr(ip), dnsmessage.TypePTR)
+	if err == nil && len(rrs) == 0 {
+		err = &net.DNSError{Err: errNoSuchHost.Error(), Name: addr, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, err
+	}
+	malformed := false
+	for _, rr := range rrs {
+		ptr := rr.Body.(*dnsmessage.PTRResource)
+		if !validName(ptr.PTR.String()) {
+			malformed = true
+			continue
+		}
+		names = append(names, ptr.PTR.String())
+	}
+	if malformed {
+		return names, &net.DNSError{Err: errMalformedDNSRecords.Error(), Name: addr}
+	}
+	return names, nil
+}
+
+func (g *_Gvisor) LookupAddr(addr string) ([]string, error) {
+	return g.LookupContextAddr(context.Background(), addr)
+}
+
+// lookup query the names of the search list of name until one has records of
+// qtype, returns the records and the canonical name
+func (g *_Gvisor) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, string, error) {
+	if !isDomainName(name) {
+		return nil, "", &net.DNSError{Err: errNoSuchHost.Error(), Name: name, IsNotFound: true}
+	}
+	conf := g.resolverConf()
+	var lastErr error
+	for _, fqdn := range conf.nameList(name) {
+		rrs, cname, err := g.resolve(ctx, conf, fqdn, qtype)
+		if len(rrs) > 0 {
+			return rrs, cname, nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: errNoSuchHost.Error(), Name: name, IsNotFound: true}
+	}
+	return nil, "", lastErr
+}
+
+// resolve query the records of qtype of a fully qualified name, the CNAME
+// chain is followed when the server only answers with aliases
+func (g *_Gvisor) resolve(ctx context.Context, conf *resolverConf, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, string, error) {
+	cname := name
+	for range maxCNAMEChain {
+		msg, server, _, err := g.query(ctx, conf, cname, qtype)
+		if err != nil {
+			return nil, "", err
+		}
+		rrs, target, err := parseAnswers(msg, cname, qtype)
+		if err != nil {
+			return nil, "", &net.DNSError{Err: err.Error(), Name: name, Server: server}
+		}
+		if len(rrs) > 0 || strings.EqualFold(target, cname) {
+			return rrs, target, nil
+		}
+		cname = target
+	}
+	return nil, "", &net.DNSError{Err: errCNAMELoop.Error(), Name: name}
+}
+
+// parseAnswers get the answers of qtype owned by name or its aliases, and the
+// end of the CNAME chain of name
+func parseAnswers(msg []byte, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, string, error) {
+	p, _, err := answerParser(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	aliases := make(map[string]string)
+	var answers []dnsmessage.Resource
+	for {
+		rr, err := p.Answer()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, "", errCannotUnmarshalDNSMessage
+		}
+		if rr.Header.Class != dnsmessage.ClassINET {
+			continue
+		}
+		switch {
+		case rr.Header.Type == qtype:
+			answers = append(answers, rr)
+		case rr.Header.Type == dnsmessage.TypeCNAME:
+			aliases[strings.ToLower(rr.Header.Name.String())] = rr.Body.(*dnsmessage.CNAMEResource).CNAME.String()
+		}
+	}
+
+	owners := map[string]bool{strings.ToLower(name): true}
+	cname := name
+	for range maxCNAMEChain {
+		target, ok := aliases[strings.ToLower(cname)]
+		if !ok {
+			break
+		}
+		cname = target
+		owners[strings.ToLower(cname)] = true
+	}
+	if _, ok := aliases[strings.ToLower(cname)]; ok {
+		return nil, "", errCNAMELoop // a loop or a chain too long in one answer
+	}
+	var rrs []dnsmessage.Resource
+	for _, rr := range answers {
+		if owners[strings.ToLower(rr.Header.Name.String())] {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, cname, nil
+}
+
+// sortSRV sort by priority and shuffle by weight, RFC 2782
+func sortSRV(srvs []*net.SRV) {
+	slices.SortFunc(srvs, func(a, b *net.SRV) int { return cmp.Compare(a.Priority, b.Priority) })
+	i := 0
+	for j := 1; j <= len(srvs); j++ {
+		if j == len(srvs) || srvs[i].Priority != srvs[j].Priority {
+			shuffleByWeight(srvs[i:j])
+			i = j
+		}
+	}
+}
+
+func shuffleByWeight(srvs []*net.SRV) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(srvs) > 1 {
+		s := 0
+		n := rand.IntN(sum)
+		for i := range srvs {
+			s += int(srvs[i].Weight)
+			if s > n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
+
+// reverseAddr the in-addr.arpa or ip6.arpa name of addr
+func reverseAddr(addr netip.Addr) string {
+	const hexDigit = "0123456789abcdef"
+	var b strings.Builder
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigit[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigit[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+func absDomainName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func validName(name string) bool {
+	return name == "." || isDomainName(name)
+}
@@ -0,0 +1,176 @@
+package gvisor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// shallowStandIn answer with the records owned by the name only, the client
+// follows the aliases itself
+func shallowStandIn(records ...dnsmessage.Resource) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+			return nil
+		}
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		msg.Additionals = nil
+		for _, rr := range records {
+			if strings.EqualFold(rr.Header.Name.String(), q.Name.String()) && (rr.Header.Type == q.Type || rr.Header.Type == dnsmessage.TypeCNAME) {
+				msg.Answers = append(msg.Answers, rr)
+			}
+		}
+		out, _ := msg.Pack()
+		return out
+	}
+}
+
+// lookupStandIn a stack resolving through handle at 10.0.0.2:53 without
+// a cache
+func lookupStandIn(t *testing.T, handle func(req []byte) []byte, hosts map[string][]netip.Addr) *_Gvisor {
+	t.Helper()
+	g, up := resolverPair(t)
+	udpServer(t, up, "10.0.0.2:53", handle)
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}, Hosts: hosts, CacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestLookupCNAME(t *testing.T) {
+	records := []dnsmessage.Resource{
+		rr("www.example.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("web.example.")}),
+		rr("web.example.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("host.example.")}),
+		rr("host.example.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+		rr("loop1.example.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("loop2.example.")}),
+		rr("loop2.example.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("loop1.example.")}),
+		rr("bad.example.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("bad!name.example.")}),
+		rr("bad!name.example.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}),
+	}
+	// the chain is followed in one answer or query by query
+	for name, handle := range map[string]func([]byte) []byte{"recursive": zoneStandIn(records...), "shallow": shallowStandIn(records...)} {
+		g := lookupStandIn(t, handle, map[string][]netip.Addr{"static.example": {netip.MustParseAddr("192.0.2.9")}})
+		ctx := context.Background()
+		for _, tc := range []struct{ host, want string }{
+			{"www.example", "host.example."},
+			{"WEB.example.", "host.example."},
+			{"host.example.", "host.example."},
+			{"static.example", "static.example."},
+		} {
+			if got, err := g.LookupContextCNAME(ctx, tc.host); err != nil || got != tc.want {
+				t.Errorf("%s: cname of %s: %q, %v, want %q", name, tc.host, got, err, tc.want)
+			}
+		}
+		if addrs, err := g.LookupContextHost(ctx, "www.example."); err != nil || !slices.Equal(addrs, []string{"192.0.2.1"}) {
+			t.Errorf("%s: addresses of the alias: %q, %v", name, addrs, err)
+		}
+
+		var dnsErr *net.DNSError
+		if _, err := g.LookupContextCNAME(ctx, "loop1.example."); !errors.As(err, &dnsErr) || dnsErr.Err != errCNAMELoop.Error() {
+			t.Errorf("%s: cname loop: %v", name, err)
+		}
+		if _, err := g.LookupContextCNAME(ctx, "bad.example."); !errors.As(err, &dnsErr) || dnsErr.Err != errMalformedDNSRecords.Error() {
+			t.Errorf("%s: malformed cname: %v", name, err)
+		}
+	}
+}
+
+func TestLookupSRVMX(t *testing.T) {
+	g := lookupStandIn(t, zoneStandIn(
+		rr("_sip._udp.example.", &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("c.example."), Port: 5060, Priority: 20, Weight: 10}),
+		rr("_sip._udp.example.", &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("a.example."), Port: 5060, Priority: 10, Weight: 0}),
+		rr("_sip._udp.example.", &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("b.example."), Port: 5060, Priority: 10, Weight: 100}),
+		rr("example.", &dnsmessage.MXResource{Pref: 20, MX: dnsmessage.MustNewName("mx2.example.")}),
+		rr("example.", &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx1.example.")}),
+		rr("example.", &dnsmessage.MXResource{Pref: 30, MX: dnsmessage.MustNewName("mx3.example.")}),
+		rr("example.", &dnsmessage.MXResource{Pref: 40, MX: dnsmessage.MustNewName("bad!mx.example.")}),
+	), nil)
+	ctx := context.Background()
+
+	// by priority, a weight of 0 after the others of its priority
+	cname, srvs, err := g.LookupContextSRV(ctx, "sip", "udp", "example.")
+	if err != nil || cname != "_sip._udp.example." {
+		t.Fatalf("srv: %q, %v", cname, err)
+	}
+	var targets []string
+	for _, srv := range srvs {
+		targets = append(targets, srv.Target)
+	}
+	if !slices.Equal(targets, []string{"b.example.", "a.example.", "c.example."}) {
+		t.Fatalf("srv targets %q", targets)
+	}
+
+	// by preference, the malformed names dropped with an error
+	mxs, err := g.LookupContextMX(ctx, "example.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.Err != errMalformedDNSRecords.Error() {
+		t.Fatalf("malformed mx: %v", err)
+	}
+	var hosts []string
+	for _, mx := range mxs {
+		hosts = append(hosts, mx.Host)
+	}
+	if !slices.Equal(hosts, []string{"mx1.example.", "mx2.example.", "mx3.example."}) {
+		t.Fatalf("mx hosts %q", hosts)
+	}
+}
+
+func TestSortSRVWeights(t *testing.T) {
+	heavy := 0
+	for range 1000 {
+		srvs := []*net.SRV{
+			{Target: "light.", Priority: 1, Weight: 1},
+			{Target: "heavy.", Priority: 1, Weight: 3},
+			{Target: "backup.", Priority: 2, Weight: 100},
+		}
+		sortSRV(srvs)
+		if srvs[2].Target != "backup." {
+			t.Fatalf("sorted %s before a lower priority", srvs[2].Target)
+		}
+		if srvs[0].Target == "heavy." {
+			heavy++
+		}
+	}
+	// the heavy record comes first 3 times out of 4
+	if heavy < 650 || heavy > 850 {
+		t.Fatalf("heavy record first %d times out of 1000", heavy)
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	g := lookupStandIn(t, zoneStandIn(
+		rr("7.2.0.192.in-addr.arpa.", &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("ptr.example.")}),
+	), map[string][]netip.Addr{
+		"b.example": {netip.MustParseAddr("192.0.2.1")},
+		"a.example": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("fd00::1")},
+	})
+	ctx := context.Background()
+	for _, tc := range []struct {
+		addr string
+		want []string
+	}{
+		{"192.0.2.1", []string{"a.example.", "b.example."}},
+		{"::ffff:192.0.2.1", []string{"a.example.", "b.example."}},
+		{"fd00::1", []string{"a.example."}},
+		{"192.0.2.7", []string{"ptr.example."}},
+	} {
+		if names, err := g.LookupContextAddr(ctx, tc.addr); err != nil || !slices.Equal(names, tc.want) {
+			t.Errorf("%s: %q, %v, want %q", tc.addr, names, err, tc.want)
+		}
+	}
+	var dnsErr *net.DNSError
+	if _, err := g.LookupContextAddr(ctx, "192.0.2.8"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("unknown address: %v", err)
+	}
+	if _, err := g.LookupContextAddr(ctx, "not an address"); err == nil {
+		t.Error("looked up a bad address")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +21,10 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 )
 
+// maxDNSPacketSize the UDP payload size advertised with EDNS0, the DNS flag
+// day 2020 recommendation
+const maxDNSPacketSize = 1232
+
 var (
 	errNoSuchHost                   = errors.New("no such host")
 	errLameReferral                 = errors.New("lame referral")
@@ -37,8 +42,11 @@ var (
 )
 
 func (net *_Gvisor) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, net.Stack, fa, pn)
+	if err := net.init(); err != nil {
+		return nil, err
+	}
+	fa, pn := net.fullAddr(addr)
+	return net.dialTCP(ctx, fa, pn)
 }
 
 func (net *_Gvisor) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -50,8 +58,11 @@ func (net *_Gvisor) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gon
 }
 
 func (net *_Gvisor) DialTCPAddrPort(addr netip.AddrPort) (*gonet.TCPConn, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.DialTCP(net.Stack, fa, pn)
+	if err := net.init(); err != nil {
+		return nil, err
+	}
+	fa, pn := net.fullAddr(addr)
+	return net.dialTCP(context.Background(), fa, pn)
 }
 
 func (net *_Gvisor) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -62,12 +73,17 @@ func (net *_Gvisor) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
 	return net.DialTCPAddrPort(netip.AddrPortFrom(ip, uint16(addr.Port)))
 }
 
-func (net *_Gvisor) ListenTCPAddrPort(addr netip.AddrPort) (*gonet.TCPListener, error) {
-	fa, pn := convertToFullAddr(addr)
-	return gonet.ListenTCP(net.Stack, fa, pn)
+// ListenTCPAddrPort listen on addr, accepted connections get the keepalive
+// options like those of Listen
+func (net *_Gvisor) ListenTCPAddrPort(addr netip.AddrPort) (net.Listener, error) {
+	if err := net.init(); err != nil {
+		return nil, err
+	}
+	fa, pn := net.fullAddr(addr)
+	return net.listenTCP(fa, pn)
 }
 
-func (net *_Gvisor) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
+func (net *_Gvisor) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
 	if addr == nil {
 		return net.ListenTCPAddrPort(netip.AddrPort{})
 	}
@@ -76,16 +92,19 @@ func (net *_Gvisor) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
 }
 
 func (net *_Gvisor) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
+	if err := net.init(); err != nil {
+		return nil, err
+	}
 	var lfa, rfa *tcpip.FullAddress
 	var pn tcpip.NetworkProtocolNumber
 	if laddr.IsValid() || laddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(laddr)
+		addr, pn = net.fullAddr(laddr)
 		lfa = &addr
 	}
 	if raddr.IsValid() || raddr.Port() > 0 {
 		var addr tcpip.FullAddress
-		addr, pn = convertToFullAddr(raddr)
+		addr, pn = net.fullAddr(raddr)
 		rfa = &addr
 	}
 	return gonet.DialUDP(net.Stack, lfa, rfa, pn)
@@ -112,12 +131,16 @@ func (net *_Gvisor) ListenUDP(laddr *net.UDPAddr) (*gonet.UDPConn, error) {
 	return net.DialUDP(laddr, nil)
 }
 
-func (tnet *_Gvisor) tryOneName(ctx context.Context, name string, qtype dnsmessage.Type) (dnsmessage.Parser, string, error) {
+func (tnet *_Gvisor) tryOneName(ctx context.Context, conf *resolverConf, name string, qtype dnsmessage.Type) ([]byte, string, error) {
+	set := conf.route(name)
+	if len(set.servers) == 0 {
+		return nil, "", &net.DNSError{Err: errNoDNSServers.Error(), Name: name}
+	}
 	var lastErr error
 
 	n, err := dnsmessage.NewName(name)
 	if err != nil {
-		return dnsmessage.Parser{}, "", errCannotMarshalDNSMessage
+		return nil, "", errCannotMarshalDNSMessage
 	}
 	q := dnsmessage.Question{
 		Name:  n,
@@ -125,62 +148,50 @@ func (tnet *_Gvisor) tryOneName(ctx context.Context, name string, qtype dnsmessa
 		Class: dnsmessage.ClassINET,
 	}
 
-	for i := 0; i < 2; i++ {
-		for _, server := range tnet.dnsServers {
-			p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
-			if err != nil {
-				dnsErr := &net.DNSError{
-					Err:    err.Error(),
-					Name:   name,
-					Server: server.String(),
-				}
-				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-					dnsErr.IsTimeout = true
+	for i := 0; i < set.attempts; i++ {
+		for _, server := range tnet.serverList(conf, set.servers) {
+			msg, err := tnet.exchange(ctx, conf, server, q, set.timeout)
+			if err == nil {
+				var p dnsmessage.Parser
+				var h dnsmessage.Header
+				p, h, err = answerParser(msg)
+				if err == nil {
+					err = checkHeader(&p, h)
 				}
-				if _, ok := err.(*net.OpError); ok {
-					dnsErr.IsTemporary = true
+				if err == nil {
+					err = skipToAnswer(&p, qtype)
 				}
-				lastErr = dnsErr
-				continue
 			}
-
-			if err := checkHeader(&p, h); err != nil {
-				dnsErr := &net.DNSError{
-					Err:    err.Error(),
-					Name:   name,
-					Server: server.String(),
-				}
-				if err == errServerTemporarilyMisbehaving {
-					dnsErr.IsTemporary = true
-				}
-				if err == errNoSuchHost {
-					dnsErr.IsNotFound = true
-					return p, server.String(), dnsErr
+			if err == errNoSuchHost {
+				return msg, server.String(), &net.DNSError{
+					Err:        err.Error(),
+					Name:       name,
+					Server:     server.String(),
+					IsNotFound: true,
 				}
-				lastErr = dnsErr
-				continue
 			}
-
-			err = skipToAnswer(&p, qtype)
 			if err == nil {
-				return p, server.String(), nil
+				return msg, server.String(), nil
 			}
-			lastErr = &net.DNSError{
+			dnsErr := &net.DNSError{
 				Err:    err.Error(),
 				Name:   name,
 				Server: server.String(),
 			}
-			if err == errNoSuchHost {
-				lastErr.(*net.DNSError).IsNotFound = true
-				return p, server.String(), lastErr
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				dnsErr.IsTimeout = true
 			}
+			if _, ok := err.(*net.OpError); ok || err == errServerTemporarilyMisbehaving {
+				dnsErr.IsTemporary = true
+			}
+			lastErr = dnsErr
 		}
 	}
-	return dnsmessage.Parser{}, "", lastErr
+	return nil, "", lastErr
 }
 
 func (tnet *_Gvisor) LookupContextHost(ctx context.Context, host string) ([]string, error) {
-	if host == "" || (!tnet.hasV6 && !tnet.hasV4) {
+	if host == "" {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
 	}
 	zlen := len(host)
@@ -193,34 +204,64 @@ func (tnet *_Gvisor) LookupContextHost(ctx context.Context, host string) ([]stri
 		return []string{ip.String()}, nil
 	}
 
-	if !isDomainName(host) {
+	// the address selection and the query families need the nic addresses
+	if err := tnet.init(); err != nil {
+		return nil, err
+	}
+	conf := tnet.resolverConf()
+	if addrs, ok := conf.lookupHosts(host); ok {
+		addrs = slices.Clone(addrs) // the table is shared
+		tnet.sortByRFC6724(addrs)
+		return addrStrings(addrs), nil
+	}
+	if !isDomainName(host) || (!tnet.hasV6() && !tnet.hasV4()) {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
 	}
+	var lastErr error
+	for _, name := range conf.nameList(host) {
+		addrs, err := tnet.lookupIPName(ctx, conf, name)
+		if len(addrs) > 0 {
+			return addrStrings(addrs), nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+// lookupIPName query the addresses of a fully qualified name
+func (tnet *_Gvisor) lookupIPName(ctx context.Context, conf *resolverConf, host string) ([]netip.Addr, error) {
 	type result struct {
-		p      dnsmessage.Parser
-		server string
+		rrs []dnsmessage.Resource
 		error
 	}
 	var addrsV4, addrsV6 []netip.Addr
 	lanes := 0
-	if tnet.hasV4 {
+	if tnet.hasV4() {
 		lanes++
 	}
-	if tnet.hasV6 {
+	if tnet.hasV6() {
 		lanes++
 	}
 	lane := make(chan result, lanes)
 	var lastErr error
-	if tnet.hasV4 {
+	if tnet.hasV4() {
 		go func() {
-			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeA)
-			lane <- result{p, server, err}
+			rrs, _, err := tnet.resolve(ctx, conf, host, dnsmessage.TypeA)
+			lane <- result{rrs, err}
 		}()
 	}
-	if tnet.hasV6 {
+	if tnet.hasV6() {
 		go func() {
-			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeAAAA)
-			lane <- result{p, server, err}
+			rrs, _, err := tnet.resolve(ctx, conf, host, dnsmessage.TypeAAAA)
+			lane <- result{rrs, err}
 		}()
 	}
 	for l := 0; l < lanes; l++ {
@@ -231,74 +272,30 @@ func (tnet *_Gvisor) LookupContextHost(ctx context.Context, host string) ([]stri
 			}
 			continue
 		}
-
-	loop:
-		for {
-			h, err := result.p.AnswerHeader()
-			if err != nil && err != dnsmessage.ErrSectionDone {
-				lastErr = &net.DNSError{
-					Err:    errCannotMarshalDNSMessage.Error(),
-					Name:   host,
-					Server: result.server,
-				}
-			}
-			if err != nil {
-				break
-			}
-			switch h.Type {
-			case dnsmessage.TypeA:
-				a, err := result.p.AResource()
-				if err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				addrsV4 = append(addrsV4, netip.AddrFrom4(a.A))
-
-			case dnsmessage.TypeAAAA:
-				aaaa, err := result.p.AAAAResource()
-				if err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				addrsV6 = append(addrsV6, netip.AddrFrom16(aaaa.AAAA))
-
-			default:
-				if err := result.p.SkipAnswer(); err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				continue
+		for _, rr := range result.rrs {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrsV4 = append(addrsV4, netip.AddrFrom4(body.A))
+			case *dnsmessage.AAAAResource:
+				addrsV6 = append(addrsV6, netip.AddrFrom16(body.AAAA))
 			}
 		}
 	}
-	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled
-	var addrs []netip.Addr
-	if tnet.hasV6 {
-		addrs = append(addrsV6, addrsV4...)
-	} else {
-		addrs = append(addrsV4, addrsV6...)
-	}
+	addrs := append(addrsV6, addrsV4...)
+	tnet.sortByRFC6724(addrs)
 
 	if len(addrs) == 0 && lastErr != nil {
 		return nil, lastErr
 	}
+	return addrs, nil
+}
+
+func addrStrings(addrs []netip.Addr) []string {
 	saddrs := make([]string, 0, len(addrs))
 	for _, ip := range addrs {
 		saddrs = append(saddrs, ip.String())
 	}
-	return saddrs, nil
+	return saddrs
 }
 
 func (tnet *_Gvisor) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
@@ -346,6 +343,9 @@ func (tnet *_Gvisor) DialContext(ctx context.Context, network, address string) (
 	if len(addrs) == 0 && len(allAddr) != 0 {
 		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
 	}
+	if matches[1] == "tcp" && len(addrs) > 1 {
+		return tnet.dialHappyEyeballs(ctx, addrs)
+	}
 
 	var firstErr error
 	for i, addr := range addrs {
@@ -407,40 +407,45 @@ func (net *_Gvisor) LookupHost(host string) (addrs []string, err error) {
 	return net.LookupContextHost(context.Background(), host)
 }
 
-func (tnet *_Gvisor) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+// exchange send q to server and return the raw response, the answer of a
+// plain server is retried over TCP when it is truncated
+func (tnet *_Gvisor) exchange(ctx context.Context, conf *resolverConf, server dnsServer, q dnsmessage.Question, timeout time.Duration) ([]byte, error) {
 	q.Class = dnsmessage.ClassINET
+	switch server.scheme {
+	case "tls":
+		return tnet.exchangeTLS(ctx, conf, server, q, timeout)
+	case "https":
+		return tnet.exchangeHTTPS(ctx, conf, server, q, timeout)
+	}
 	id, udpReq, tcpReq, err := newRequest(q)
 	if err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
+		return nil, errCannotMarshalDNSMessage
 	}
 
 	for _, useUDP := range []bool{true, false} {
 		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(timeout))
 		defer cancel()
 
-		var c net.Conn
-		var err error
+		network := "tcp"
 		if useUDP {
-			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(server, 53))
-		} else {
-			c, err = tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(server, 53))
+			network = "udp"
 		}
+		c, err := tnet.dialServer(ctx, network, server)
 
 		if err != nil {
-			return dnsmessage.Parser{}, dnsmessage.Header{}, err
+			return nil, err
 		}
 		if d, ok := ctx.Deadline(); ok && !d.IsZero() {
 			err := c.SetDeadline(d)
 			if err != nil {
-				return dnsmessage.Parser{}, dnsmessage.Header{}, err
+				return nil, err
 			}
 		}
-		var p dnsmessage.Parser
-		var h dnsmessage.Header
+		var msg []byte
 		if useUDP {
-			p, h, err = dnsPacketRoundTrip(c, id, q, udpReq)
+			msg, err = dnsPacketRoundTrip(c, id, q, udpReq)
 		} else {
-			p, h, err = dnsStreamRoundTrip(c, id, q, tcpReq)
+			msg, err = dnsStreamRoundTrip(c, id, q, tcpReq)
 		}
 		c.Close()
 		if err != nil {
@@ -449,20 +454,35 @@ func (tnet *_Gvisor) exchange(ctx context.Context, server netip.Addr, q dnsmessa
 			} else if err == context.DeadlineExceeded {
 				err = errTimeout
 			}
-			return dnsmessage.Parser{}, dnsmessage.Header{}, err
+			return nil, err
 		}
-		if err := p.SkipQuestion(); err != dnsmessage.ErrSectionDone {
-			return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+		_, h, err := answerParser(msg)
+		if err != nil {
+			return nil, errInvalidDNSResponse
 		}
 		if h.Truncated {
 			continue
 		}
-		return p, h, nil
+		return msg, nil
+	}
+	return nil, errNoAnswerFromDNSServer
+}
+
+// answerParser parse the header of msg and skip to the answer section
+func answerParser(msg []byte) (dnsmessage.Parser, dnsmessage.Header, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
 	}
-	return dnsmessage.Parser{}, dnsmessage.Header{}, errNoAnswerFromDNSServer
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	return p, h, nil
 }
 
-func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+// fullAddr convert endpoint to an address of the nic of g
+func (g *_Gvisor) fullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
 	var protoNumber tcpip.NetworkProtocolNumber
 	if endpoint.Addr().Is4() {
 		protoNumber = ipv4.ProtocolNumber
@@ -470,7 +490,7 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 		protoNumber = ipv6.ProtocolNumber
 	}
 	return tcpip.FullAddress{
-		NIC:  1,
+		NIC:  g.nicID,
 		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
 		Port: endpoint.Port(),
 	}, protoNumber
@@ -536,6 +556,17 @@ func newRequest(q dnsmessage.Question) (id uint16, udpReq, tcpReq []byte, err er
 	if err := b.Question(q); err != nil {
 		return 0, nil, nil, err
 	}
+	// advertise a larger UDP payload with EDNS0, RFC 6891
+	if err := b.StartAdditionals(); err != nil {
+		return 0, nil, nil, err
+	}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(maxDNSPacketSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return 0, nil, nil, err
+	}
+	if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+		return 0, nil, nil, err
+	}
 	tcpReq, err = b.Finish()
 	udpReq = tcpReq[2:]
 	l := len(tcpReq) - 2
@@ -577,15 +608,15 @@ func checkResponse(reqID uint16, reqQues dnsmessage.Question, respHdr dnsmessage
 	return true
 }
 
-func dnsPacketRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []byte) (dnsmessage.Parser, dnsmessage.Header, error) {
+func dnsPacketRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []byte) ([]byte, error) {
 	if _, err := c.Write(b); err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+		return nil, err
 	}
-	b = make([]byte, 512)
+	b = make([]byte, maxDNSPacketSize)
 	for {
 		n, err := c.Read(b)
 		if err != nil {
-			return dnsmessage.Parser{}, dnsmessage.Header{}, err
+			return nil, err
 		}
 		var p dnsmessage.Parser
 		h, err := p.Start(b[:n])
@@ -596,17 +627,17 @@ func dnsPacketRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []by
 		if err != nil || !checkResponse(id, query, h, q) {
 			continue
 		}
-		return p, h, nil
+		return b[:n], nil
 	}
 }
 
-func dnsStreamRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []byte) (dnsmessage.Parser, dnsmessage.Header, error) {
+func dnsStreamRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []byte) ([]byte, error) {
 	if _, err := c.Write(b); err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+		return nil, err
 	}
 	b = make([]byte, 1280)
 	if _, err := io.ReadFull(c, b[:2]); err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+		return nil, err
 	}
 	l := int(b[0])<<8 | int(b[1])
 	if l > len(b) {
@@ -614,21 +645,21 @@ func dnsStreamRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []by
 	}
 	n, err := io.ReadFull(c, b[:l])
 	if err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+		return nil, err
 	}
 	var p dnsmessage.Parser
 	h, err := p.Start(b[:n])
 	if err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+		return nil, errCannotUnmarshalDNSMessage
 	}
 	q, err := p.Question()
 	if err != nil {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+		return nil, errCannotUnmarshalDNSMessage
 	}
 	if !checkResponse(id, query, h, q) {
-		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+		return nil, errInvalidDNSResponse
 	}
-	return p, h, nil
+	return b[:n], nil
 }
 
 func checkHeader(p *dnsmessage.Parser, h dnsmessage.Header) error {
@@ -660,8 +691,8 @@ func skipToAnswer(p *dnsmessage.Parser, qtype dnsmessage.Type) error {
 		if err != nil {
 			return errCannotUnmarshalDNSMessage
 		}
-		if h.Type == qtype {
-			return nil
+		if h.Type == qtype || h.Type == dnsmessage.TypeCNAME {
+			return nil // aliases are followed by resolve
 		}
 		if err := p.SkipAnswer(); err != nil {
 			return errCannotUnmarshalDNSMessage
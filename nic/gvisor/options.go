@@ -0,0 +1,220 @@
+package gvisor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	defaultQueueSize   = 512
+	defaultLinkAddress = "00:ab:00:00:00:00"
+)
+
+// Options tune the gVisor stack, zero fields keep the defaults
+type Options struct {
+	// NetworkProtocols default ipv4 and ipv6
+	NetworkProtocols []stack.NetworkProtocolFactory
+	// TransportProtocols default tcp, udp, icmp4 and icmp6
+	TransportProtocols []stack.TransportProtocolFactory
+
+	// TCPSendBuffer size range of TCP send buffers in bytes
+	TCPSendBuffer BufferRange
+	// TCPReceiveBuffer size range of TCP receive buffers in bytes
+	TCPReceiveBuffer BufferRange
+	// CongestionControl "reno" or "cubic", default reno
+	CongestionControl string
+	// SACK enable selective acknowledgements
+	SACK bool
+	// ModerateReceiveBuffer grow receive buffers with the connection throughput
+	ModerateReceiveBuffer bool
+	// Nagle enable Nagle's algorithm to coalesce small segments, the stack
+	// default for new connections
+	Nagle bool
+	// DelayedACK delay acknowledgements. gVisor TCP acknowledges every segment
+	// at once and has no such option, Validate rejects it
+	DelayedACK bool
+	// RACK enable RACK loss detection, disabled by default
+	RACK bool
+
+	// KeepaliveIdle enable TCP keepalive after the connection is idle this
+	// long. applied to connections dialed by the stack and accepted by Listen
+	KeepaliveIdle time.Duration
+	// KeepaliveInterval between keepalive probes, default 75s
+	KeepaliveInterval time.Duration
+	// KeepaliveCount unanswered probes before the connection is dropped, default 9
+	KeepaliveCount int
+
+	// TTL default ipv4 time to live, default 64
+	TTL uint8
+	// HopLimit default ipv6 hop limit, default 64
+	HopLimit uint8
+
+	// QueueSize depth of the outbound packet queue, default 512
+	QueueSize int
+	// LinkAddress MAC address of the nic, default 00:ab:00:00:00:00
+	LinkAddress string
+}
+
+// BufferRange a buffer size range, zero keeps the stack default
+type BufferRange struct {
+	Min, Default, Max int
+}
+
+func (r BufferRange) isZero() bool {
+	return r == BufferRange{}
+}
+
+func (r BufferRange) validate() error {
+	if r.isZero() {
+		return nil
+	}
+	if r.Min <= 0 || r.Default < r.Min || r.Max < r.Default {
+		return fmt.Errorf("want 0 < min <= default <= max, got %d/%d/%d", r.Min, r.Default, r.Max)
+	}
+	return nil
+}
+
+// Validate check the options
+func (o *Options) Validate() error {
+	var errs []error
+	if err := o.TCPSendBuffer.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tcp send buffer: %w", err))
+	}
+	if err := o.TCPReceiveBuffer.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tcp receive buffer: %w", err))
+	}
+	switch o.CongestionControl {
+	case "", "reno", "cubic":
+	default:
+		errs = append(errs, fmt.Errorf("unknown congestion control %q", o.CongestionControl))
+	}
+	if o.DelayedACK {
+		errs = append(errs, errors.New("delayed ack is not supported by gvisor tcp"))
+	}
+	if o.KeepaliveIdle < 0 || o.KeepaliveInterval < 0 || o.KeepaliveCount < 0 {
+		errs = append(errs, errors.New("negative keepalive option"))
+	}
+	if o.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("negative queue size %d", o.QueueSize))
+	}
+	if o.LinkAddress != "" {
+		if mac, err := net.ParseMAC(o.LinkAddress); err != nil {
+			errs = append(errs, fmt.Errorf("link address: %w", err))
+		} else if len(mac) != 6 {
+			errs = append(errs, fmt.Errorf("link address %s is not an ethernet address", o.LinkAddress))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (o *Options) stackOptions() stack.Options {
+	opts := stack.Options{
+		NetworkProtocols:   o.NetworkProtocols,
+		TransportProtocols: o.TransportProtocols,
+	}
+	if opts.NetworkProtocols == nil {
+		opts.NetworkProtocols = []stack.NetworkProtocolFactory{
+			ipv4.NewProtocol,
+			ipv6.NewProtocol,
+		}
+	}
+	if opts.TransportProtocols == nil {
+		opts.TransportProtocols = []stack.TransportProtocolFactory{
+			tcp.NewProtocol,
+			udp.NewProtocol,
+			icmp.NewProtocol4,
+			icmp.NewProtocol6,
+		}
+	}
+	return opts
+}
+
+// apply set the protocol options of s
+func (o *Options) apply(s *stack.Stack) error {
+	var tcpOpts []tcpip.SettableTransportProtocolOption
+	if !o.TCPSendBuffer.isZero() {
+		tcpOpts = append(tcpOpts, &tcpip.TCPSendBufferSizeRangeOption{
+			Min: o.TCPSendBuffer.Min, Default: o.TCPSendBuffer.Default, Max: o.TCPSendBuffer.Max,
+		})
+	}
+	if !o.TCPReceiveBuffer.isZero() {
+		tcpOpts = append(tcpOpts, &tcpip.TCPReceiveBufferSizeRangeOption{
+			Min: o.TCPReceiveBuffer.Min, Default: o.TCPReceiveBuffer.Default, Max: o.TCPReceiveBuffer.Max,
+		})
+	}
+	if o.CongestionControl != "" {
+		cc := tcpip.CongestionControlOption(o.CongestionControl)
+		tcpOpts = append(tcpOpts, &cc)
+	}
+	sack := tcpip.TCPSACKEnabled(o.SACK)
+	moderate := tcpip.TCPModerateReceiveBufferOption(o.ModerateReceiveBuffer)
+	delay := tcpip.TCPDelayEnabled(o.Nagle)
+	recovery := tcpip.TCPRecovery(0)
+	if o.RACK {
+		recovery = tcpip.TCPRACKLossDetection
+	}
+	tcpOpts = append(tcpOpts, &sack, &moderate, &delay, &recovery)
+	if s.TransportProtocolInstance(tcp.ProtocolNumber) != nil {
+		for _, opt := range tcpOpts {
+			if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+				return fmt.Errorf("set tcp option %T: %s", opt, err)
+			}
+		}
+	}
+
+	if o.TTL != 0 && s.CheckNetworkProtocol(ipv4.ProtocolNumber) {
+		ttl := tcpip.DefaultTTLOption(o.TTL)
+		if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, &ttl); err != nil {
+			return fmt.Errorf("set ipv4 ttl: %s", err)
+		}
+	}
+	if o.HopLimit != 0 && s.CheckNetworkProtocol(ipv6.ProtocolNumber) {
+		hopLimit := tcpip.DefaultTTLOption(o.HopLimit)
+		if err := s.SetNetworkProtocolOption(ipv6.ProtocolNumber, &hopLimit); err != nil {
+			return fmt.Errorf("set ipv6 hop limit: %s", err)
+		}
+	}
+	return nil
+}
+
+// setKeepalive apply the keepalive defaults to a TCP endpoint
+func (o *Options) setKeepalive(ep tcpip.Endpoint) {
+	if o.KeepaliveIdle == 0 {
+		return
+	}
+	idle := tcpip.KeepaliveIdleOption(o.KeepaliveIdle)
+	ep.SetSockOpt(&idle)
+	if o.KeepaliveInterval != 0 {
+		interval := tcpip.KeepaliveIntervalOption(o.KeepaliveInterval)
+		ep.SetSockOpt(&interval)
+	}
+	if o.KeepaliveCount != 0 {
+		ep.SetSockOptInt(tcpip.KeepaliveCountOption, o.KeepaliveCount)
+	}
+	ep.SocketOptions().SetKeepAlive(true)
+}
+
+// CreateWithOptions create a gVisor nic with tuned stack options, the options
+// are validated before the stack is created
+func CreateWithOptions(cfg nic.Config, opts Options) (*_Gvisor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("gvisor options: %w", err)
+	}
+	s := stack.New(opts.stackOptions())
+	if err := opts.apply(s); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("gvisor options: %w", err)
+	}
+	return &_Gvisor{Config: cfg, Options: opts, Stack: s, flows: &flowTable{}}, nil
+}
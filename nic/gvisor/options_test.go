@@ -0,0 +1,90 @@
+package gvisor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"zero", Options{}, ""},
+		{"buffers", Options{
+			TCPSendBuffer:    BufferRange{Min: 4096, Default: 4096, Max: 1 << 20},
+			TCPReceiveBuffer: BufferRange{Min: 4096, Default: 65536, Max: 1 << 20},
+		}, ""},
+		{"reno", Options{CongestionControl: "reno"}, ""},
+		{"cubic", Options{CongestionControl: "cubic"}, ""},
+		{"mac", Options{LinkAddress: "02:00:00:00:00:01"}, ""},
+		{"keepalive", Options{KeepaliveIdle: time.Minute, KeepaliveInterval: time.Second, KeepaliveCount: 3}, ""},
+
+		{"min above default", Options{TCPSendBuffer: BufferRange{Min: 8192, Default: 4096, Max: 1 << 20}}, "tcp send buffer"},
+		{"default above max", Options{TCPReceiveBuffer: BufferRange{Min: 1, Default: 8192, Max: 4096}}, "tcp receive buffer"},
+		{"zero min", Options{TCPReceiveBuffer: BufferRange{Default: 4096, Max: 8192}}, "tcp receive buffer"},
+		{"congestion control", Options{CongestionControl: "bbr"}, `unknown congestion control "bbr"`},
+		{"delayed ack", Options{DelayedACK: true}, "delayed ack"},
+		{"keepalive", Options{KeepaliveCount: -1}, "negative keepalive"},
+		{"queue size", Options{QueueSize: -1}, "negative queue size"},
+		{"bad mac", Options{LinkAddress: "00:ab:00"}, "link address"},
+		{"long mac", Options{LinkAddress: "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"}, "not an ethernet address"},
+
+		// all the errors are reported
+		{"several", Options{CongestionControl: "bbr", QueueSize: -1}, "negative queue size"},
+	} {
+		err := tc.opts.Validate()
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestCreateWithOptions(t *testing.T) {
+	if _, err := CreateWithOptions(nic.Config{}, Options{CongestionControl: "bbr"}); err == nil {
+		t.Fatal("created with bad options")
+	}
+
+	g, err := CreateWithOptions(nic.Config{MTU: 1500, IPv4: "10.0.0.1/24"}, Options{
+		TCPSendBuffer:     BufferRange{Min: 4096, Default: 8192, Max: 1 << 20},
+		CongestionControl: "cubic",
+		SACK:              true,
+		TTL:               32,
+		HopLimit:          16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	var cc tcpip.CongestionControlOption
+	if err := g.Stack.TransportProtocolOption(tcp.ProtocolNumber, &cc); err != nil || cc != "cubic" {
+		t.Fatalf("congestion control %q, %v", cc, err)
+	}
+	var sack tcpip.TCPSACKEnabled
+	if err := g.Stack.TransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil || !sack {
+		t.Fatalf("sack %v, %v", sack, err)
+	}
+	var send tcpip.TCPSendBufferSizeRangeOption
+	if err := g.Stack.TransportProtocolOption(tcp.ProtocolNumber, &send); err != nil || send.Default != 8192 {
+		t.Fatalf("send buffer %+v, %v", send, err)
+	}
+	var ttl, hopLimit tcpip.DefaultTTLOption
+	if err := g.Stack.NetworkProtocolOption(ipv4.ProtocolNumber, &ttl); err != nil || ttl != 32 {
+		t.Fatalf("ttl %d, %v", ttl, err)
+	}
+	if err := g.Stack.NetworkProtocolOption(ipv6.ProtocolNumber, &hopLimit); err != nil || hopLimit != 16 {
+		t.Fatalf("hop limit %d, %v", hopLimit, err)
+	}
+}
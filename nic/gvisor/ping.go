@@ -21,6 +21,7 @@ type _PingConn struct {
 	raddr    _PingAddr
 	wq       waiter.Queue
 	ep       tcpip.Endpoint
+	nicID    tcpip.NICID
 	deadline *time.Timer
 }
 
@@ -80,7 +81,7 @@ func (pc *_PingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 
 	buf := bytes.NewReader(p)
-	rfa, _ := convertToFullAddr(netip.AddrPortFrom(na, 0))
+	rfa := tcpip.FullAddress{NIC: pc.nicID, Addr: tcpip.AddrFromSlice(na.AsSlice())}
 	// won't block, no deadlines
 	n64, tcpipErr := pc.ep.Write(buf, tcpip.WriteOptions{
 		To: &rfa,
@@ -135,6 +136,9 @@ func (pc *_PingConn) SetReadDeadline(t time.Time) error {
 }
 
 func (net *_Gvisor) DialPingAddr(laddr, raddr netip.Addr) (*_PingConn, error) {
+	if err := net.init(); err != nil {
+		return nil, err
+	}
 	if !laddr.IsValid() && !raddr.IsValid() {
 		return nil, errors.New("ping dial: invalid address")
 	}
@@ -157,6 +161,7 @@ func (net *_Gvisor) DialPingAddr(laddr, raddr netip.Addr) (*_PingConn, error) {
 
 	pc := &_PingConn{
 		laddr:    _PingAddr{laddr},
+		nicID:    net.nicID,
 		deadline: time.NewTimer(time.Hour << 10),
 	}
 	pc.deadline.Stop()
@@ -168,7 +173,7 @@ func (net *_Gvisor) DialPingAddr(laddr, raddr netip.Addr) (*_PingConn, error) {
 	pc.ep = ep
 
 	if bind {
-		fa, _ := convertToFullAddr(netip.AddrPortFrom(laddr, 0))
+		fa, _ := net.fullAddr(netip.AddrPortFrom(laddr, 0))
 		if tcpipErr = pc.ep.Bind(fa); tcpipErr != nil {
 			return nil, fmt.Errorf("ping bind: %s", tcpipErr)
 		}
@@ -176,7 +181,7 @@ func (net *_Gvisor) DialPingAddr(laddr, raddr netip.Addr) (*_PingConn, error) {
 
 	if raddr.IsValid() {
 		pc.raddr = _PingAddr{raddr}
-		fa, _ := convertToFullAddr(netip.AddrPortFrom(raddr, 0))
+		fa, _ := net.fullAddr(netip.AddrPortFrom(raddr, 0))
 		if tcpipErr = pc.ep.Connect(fa); tcpipErr != nil {
 			return nil, fmt.Errorf("ping connect: %s", tcpipErr)
 		}
@@ -0,0 +1,368 @@
+package gvisor
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSTimeout  = 5 * time.Second
+	defaultDNSAttempts = 2
+	maxNDots           = 15
+)
+
+// ResolverConfig configures the DNS resolver used by LookupHost and Dial,
+// it can be changed at runtime with SetResolverConfig
+type ResolverConfig struct {
+	// Servers upstream DNS servers as "ip" or "ip:port" with port 53 by
+	// default, "tls://host[:port]" for DNS over TLS with port 853 or
+	// "https://host[:port][/path]" for DNS over HTTPS with /dns-query. the
+	// host of an encrypted server is an ip address or an entry of Hosts.
+	// HostResolver stands for the name servers of the host
+	Servers []string
+	// Rules send the names under a suffix to other servers, the rule with the
+	// longest matching suffix wins, other names go to Servers
+	Rules []ResolverRule
+	// TLSConfig of the encrypted servers, e.g. RootCAs or InsecureSkipVerify,
+	// ServerName defaults to the host of the server url
+	TLSConfig *tls.Config
+	// Search domains appended to names with less than NDots dots
+	Search []string
+	// NDots default 1
+	NDots int
+	// Timeout of a query to one server, default 5s
+	Timeout time.Duration
+	// Attempts over the server list, default 2
+	Attempts int
+	// Rotate spread the queries over the servers instead of always asking
+	// the first one first
+	Rotate bool
+	// Hosts static name to addresses table, consulted before the servers
+	Hosts map[string][]netip.Addr
+	// CacheSize max cached answers, default 1024, negative disables the cache
+	CacheSize int
+	// CacheMaxTTL caps the record TTLs, default 24h
+	CacheMaxTTL time.Duration
+}
+
+// ResolverRule a split DNS rule
+type ResolverRule struct {
+	// Suffix "corp.example" or "*.corp.example" matches the domain and its
+	// subdomains
+	Suffix string
+	// Servers like ResolverConfig.Servers
+	Servers []string
+	// Timeout and Attempts default to those of the resolver config
+	Timeout  time.Duration
+	Attempts int
+}
+
+// HostResolver in a server list stands for the name servers of the host, read
+// from /etc/resolv.conf when the config is set and queried through the host
+// network instead of the netstack
+const HostResolver = "host"
+
+var resolvConfPath = "/etc/resolv.conf"
+
+// resolverConf is a parsed ResolverConfig
+type resolverConf struct {
+	cfg ResolverConfig
+
+	upstreamSet
+	rules  []resolverRule // longest suffix first
+	search []string       // fqdn
+	ndots  int
+	hosts  map[string][]netip.Addr // lowercase name without trailing dot
+
+	cacheSize   int
+	cacheMaxTTL time.Duration
+
+	upstreams *upstreams
+}
+
+// SetResolverConfig validate and apply the resolver config, queries in
+// flight keep the previous one and its connections until they are done. the
+// DNS cache is flushed
+func (g *_Gvisor) SetResolverConfig(cfg ResolverConfig) error {
+	conf, err := parseResolverConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("resolver config: %w", err)
+	}
+	if old := g.resolver.Swap(conf); old != nil {
+		old.upstreams.retire()
+	}
+	g.FlushDNSCache()
+	return nil
+}
+
+// ResolverConfig get the resolver config
+func (g *_Gvisor) ResolverConfig() ResolverConfig {
+	return g.resolverConf().cfg
+}
+
+// resolverConf the config set or else the default one, parsed once
+func (g *_Gvisor) resolverConf() *resolverConf {
+	if conf := g.resolver.Load(); conf != nil {
+		return conf
+	}
+	conf, _ := parseResolverConfig(ResolverConfig{})
+	if g.resolver.CompareAndSwap(nil, conf) {
+		return conf
+	}
+	return g.resolver.Load()
+}
+
+// upstreamSet servers queried together, the default ones or those of a rule
+type upstreamSet struct {
+	servers  []dnsServer
+	timeout  time.Duration
+	attempts int
+}
+
+type resolverRule struct {
+	suffix string // lowercase fqdn
+	upstreamSet
+}
+
+func parseResolverConfig(cfg ResolverConfig) (*resolverConf, error) {
+	cfg.Servers = slices.Clone(cfg.Servers)
+	cfg.Search = slices.Clone(cfg.Search)
+	cfg.Rules = slices.Clone(cfg.Rules)
+	conf := &resolverConf{
+		upstreamSet: upstreamSet{timeout: defaultDNSTimeout, attempts: defaultDNSAttempts},
+		ndots:       1,
+		hosts:       make(map[string][]netip.Addr, len(cfg.Hosts)),
+		cacheSize:   cmp.Or(cfg.CacheSize, defaultDNSCacheSize),
+		cacheMaxTTL: cmp.Or(cfg.CacheMaxTTL, defaultDNSCacheMaxTTL),
+		upstreams:   &upstreams{},
+	}
+	var errs []error
+	for _, domain := range cfg.Search {
+		domain = strings.TrimSuffix(domain, ".")
+		if !isDomainName(domain) {
+			errs = append(errs, fmt.Errorf("invalid search domain %q", domain))
+			continue
+		}
+		conf.search = append(conf.search, domain+".")
+	}
+	switch {
+	case cfg.NDots < 0:
+		errs = append(errs, fmt.Errorf("negative ndots %d", cfg.NDots))
+	case cfg.NDots > 0:
+		conf.ndots = min(cfg.NDots, maxNDots)
+	}
+	switch {
+	case cfg.Timeout < 0:
+		errs = append(errs, fmt.Errorf("negative timeout %s", cfg.Timeout))
+	case cfg.Timeout > 0:
+		conf.timeout = cfg.Timeout
+	}
+	switch {
+	case cfg.Attempts < 0:
+		errs = append(errs, fmt.Errorf("negative attempts %d", cfg.Attempts))
+	case cfg.Attempts > 0:
+		conf.attempts = cfg.Attempts
+	}
+	if cfg.CacheMaxTTL < 0 {
+		errs = append(errs, fmt.Errorf("negative cache max ttl %s", cfg.CacheMaxTTL))
+	}
+	hosts := make(map[string][]netip.Addr, len(cfg.Hosts))
+	for name, addrs := range cfg.Hosts {
+		key := hostsKey(name)
+		if !isDomainName(key) {
+			errs = append(errs, fmt.Errorf("invalid host name %q", name))
+			continue
+		}
+		hosts[name] = slices.Clone(addrs)
+		for _, addr := range addrs {
+			conf.hosts[key] = append(conf.hosts[key], addr.Unmap())
+		}
+	}
+	cfg.Hosts = hosts
+	conf.servers = parseDNSServers(cfg.Servers, conf.hosts, &errs)
+	for i, r := range cfg.Rules {
+		cfg.Rules[i].Servers = slices.Clone(r.Servers)
+		rule, err := conf.parseRule(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", r.Suffix, err))
+			continue
+		}
+		conf.rules = append(conf.rules, rule)
+	}
+	slices.SortStableFunc(conf.rules, func(a, b resolverRule) int {
+		return cmp.Compare(len(b.suffix), len(a.suffix))
+	})
+	conf.cfg = cfg
+	return conf, errors.Join(errs...)
+}
+
+func (conf *resolverConf) parseRule(r ResolverRule) (resolverRule, error) {
+	suffix := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(r.Suffix, "*."), "."))
+	if !isDomainName(suffix) {
+		return resolverRule{}, errors.New("invalid suffix")
+	}
+	if len(r.Servers) == 0 {
+		return resolverRule{}, errors.New("no servers")
+	}
+	rule := resolverRule{suffix: suffix + ".", upstreamSet: upstreamSet{timeout: conf.timeout, attempts: conf.attempts}}
+	var errs []error
+	switch {
+	case r.Timeout < 0:
+		errs = append(errs, fmt.Errorf("negative timeout %s", r.Timeout))
+	case r.Timeout > 0:
+		rule.timeout = r.Timeout
+	}
+	switch {
+	case r.Attempts < 0:
+		errs = append(errs, fmt.Errorf("negative attempts %d", r.Attempts))
+	case r.Attempts > 0:
+		rule.attempts = r.Attempts
+	}
+	rule.servers = parseDNSServers(r.Servers, conf.hosts, &errs)
+	return rule, errors.Join(errs...)
+}
+
+// route the servers for name, those of the rule with the longest matching
+// suffix or the default ones
+func (conf *resolverConf) route(name string) *upstreamSet {
+	name = strings.ToLower(name)
+	for i := range conf.rules {
+		if r := &conf.rules[i]; name == r.suffix || strings.HasSuffix(name, "."+r.suffix) {
+			return &r.upstreamSet
+		}
+	}
+	return &conf.upstreamSet
+}
+
+func parseDNSServers(list []string, hosts map[string][]netip.Addr, errs *[]error) []dnsServer {
+	var servers []dnsServer
+	for _, s := range list {
+		if s == HostResolver {
+			servers = append(servers, hostServers()...)
+			continue
+		}
+		server, err := parseDNSServer(s, hosts)
+		if err != nil {
+			*errs = append(*errs, err)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// hostServers the name servers of resolv.conf, or the local ones like the
+// stdlib resolver when there is none
+func hostServers() []dnsServer {
+	var servers []dnsServer
+	if data, err := os.ReadFile(resolvConfPath); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 2 || f[0] != "nameserver" {
+				continue
+			}
+			if addr, err := parseServer(f[1], 53); err == nil {
+				servers = append(servers, dnsServer{addr: addr, system: true})
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []dnsServer{
+			{addr: netip.MustParseAddrPort("127.0.0.1:53"), system: true},
+			{addr: netip.MustParseAddrPort("[::1]:53"), system: true},
+		}
+	}
+	return servers
+}
+
+// parseServer parse "ip", "[ip]" or "ip:port"
+func parseServer(s string, port uint16) (netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid dns server %q", s)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
+
+func hostsKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupHosts look name up in the static hosts table
+func (conf *resolverConf) lookupHosts(name string) ([]netip.Addr, bool) {
+	addrs, ok := conf.hosts[hostsKey(name)]
+	return addrs, ok
+}
+
+// nameList the fully qualified names to query for name, like the search
+// rules of resolv.conf
+func (conf *resolverConf) nameList(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	hasNdots := strings.Count(name, ".") >= conf.ndots
+	var names []string
+	if hasNdots {
+		names = append(names, name+".")
+	}
+	for _, suffix := range conf.search {
+		if fqdn := name + "." + suffix; len(fqdn) <= 254 {
+			names = append(names, fqdn)
+		}
+	}
+	if !hasNdots {
+		names = append(names, name+".")
+	}
+	return names
+}
+
+// serverList the servers in query order
+func (g *_Gvisor) serverList(conf *resolverConf, servers []dnsServer) []dnsServer {
+	if !conf.cfg.Rotate || len(servers) < 2 {
+		return servers
+	}
+	off := int(g.rotate.Add(1) % uint32(len(servers)))
+	return append(slices.Clone(servers[off:]), servers[:off]...)
+}
+
+// NewResolver a standard resolver whose queries go to the servers of the
+// resolver config through the netstack. the search list and the hosts file
+// of the stdlib resolver still come from the host, successive dials go to
+// successive servers so its retries fail over. the rules do not apply, the
+// dials do not tell the name. DNS over HTTPS servers are skipped, the stdlib
+// resolver only speaks the DNS wire format
+func (g *_Gvisor) NewResolver() *net.Resolver {
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			conf := g.resolverConf()
+			servers := slices.DeleteFunc(slices.Clone(conf.servers), func(s dnsServer) bool {
+				return s.scheme == "https"
+			})
+			if len(servers) == 0 {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: errNoDNSServers}
+			}
+			server := servers[int(next.Add(1)-1)%len(servers)]
+			if server.scheme == "tls" {
+				return g.dialTLS(ctx, conf, server) // not a PacketConn, framed like TCP
+			}
+			return g.dialServer(ctx, network, server)
+		},
+	}
+}
+
+var errNoDNSServers = errors.New("no dns servers configured")
@@ -0,0 +1,442 @@
+package gvisor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// queryLog record the names queried before handing them to handle, the
+// first drop queries go unanswered
+type queryLog struct {
+	mu     sync.Mutex
+	names  []string
+	drop   int
+	handle func(req []byte) []byte
+}
+
+func (l *queryLog) serve(req []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	l.mu.Lock()
+	l.names = append(l.names, msg.Questions[0].Name.String())
+	drop := len(l.names) <= l.drop
+	l.mu.Unlock()
+	if drop {
+		return nil
+	}
+	return l.handle(req)
+}
+
+// reset forget the queries, the next drop go unanswered
+func (l *queryLog) reset(drop int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names, l.drop = nil, drop
+}
+
+func (l *queryLog) queried() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.names)
+}
+
+// resolverPair a stack resolving through a server stack at 10.0.0.2
+func resolverPair(t *testing.T) (g, up *_Gvisor) {
+	t.Helper()
+	g = create(t, "10.0.0.1/24")
+	up = create(t, "10.0.0.2/24")
+	link(t, g, up)
+	return g, up
+}
+
+func TestResolverConfigParse(t *testing.T) {
+	hosts := map[string][]netip.Addr{"dns.example": {netip.MustParseAddr("::ffff:10.0.0.9")}}
+	conf, err := parseResolverConfig(ResolverConfig{
+		Servers: []string{"10.0.0.2", "10.0.0.3:5353", "fd00::1", "[fd00::2]:5353", "tls://dns.example", "https://10.0.0.4:8443/q"},
+		Hosts:   hosts,
+		Search:  []string{"corp.example.", "example"},
+		NDots:   20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []string
+	for _, s := range conf.servers {
+		servers = append(servers, s.addr.String())
+	}
+	want := []string{"10.0.0.2:53", "10.0.0.3:5353", "[fd00::1]:53", "[fd00::2]:5353", "10.0.0.9:853", "10.0.0.4:8443"}
+	if !slices.Equal(servers, want) {
+		t.Fatalf("servers %q, want %q", servers, want)
+	}
+	if s := conf.servers[5]; s.scheme != "https" || s.path != "/q" {
+		t.Fatalf("https server %+v", s)
+	}
+	if !slices.Equal(conf.search, []string{"corp.example.", "example."}) || conf.ndots != maxNDots {
+		t.Fatalf("search %q, ndots %d", conf.search, conf.ndots)
+	}
+	if conf.timeout != defaultDNSTimeout || conf.attempts != defaultDNSAttempts {
+		t.Fatalf("timeout %s, attempts %d", conf.timeout, conf.attempts)
+	}
+	// the config is copied
+	hosts["dns.example"][0] = netip.MustParseAddr("10.0.0.10")
+	if conf.cfg.Hosts["dns.example"][0] != netip.MustParseAddr("::ffff:10.0.0.9") {
+		t.Fatal("hosts table shared with the caller")
+	}
+
+	for _, tc := range []struct {
+		cfg ResolverConfig
+		err string
+	}{
+		{ResolverConfig{Servers: []string{"dns.example"}}, `invalid dns server "dns.example"`},
+		{ResolverConfig{Servers: []string{"10.0.0.2:99999"}}, `invalid dns server "10.0.0.2:99999"`},
+		{ResolverConfig{Servers: []string{"udp://10.0.0.2"}}, "unsupported scheme"},
+		{ResolverConfig{Servers: []string{"tls://dns.example"}}, "not an ip address or a hosts entry"},
+		{ResolverConfig{Servers: []string{"tls://10.0.0.2/path"}}, "tls takes no path"},
+		{ResolverConfig{Servers: []string{"tls://10.0.0.2:x"}}, "invalid dns server"},
+		{ResolverConfig{Search: []string{"bad domain"}}, "invalid search domain"},
+		{ResolverConfig{NDots: -1}, "negative ndots"},
+		{ResolverConfig{Timeout: -time.Second}, "negative timeout"},
+		{ResolverConfig{Attempts: -1}, "negative attempts"},
+		{ResolverConfig{Hosts: map[string][]netip.Addr{"bad host": nil}}, "invalid host name"},
+	} {
+		if _, err := parseResolverConfig(tc.cfg); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%+v: %v, want %q", tc.cfg, err, tc.err)
+		}
+	}
+
+	// a bad config is refused and the previous one kept
+	g := create(t, "10.0.0.1/24")
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"bogus"}}); err == nil {
+		t.Fatal("bad config set")
+	}
+	if s := g.ResolverConfig().Servers; !slices.Equal(s, []string{"10.0.0.2"}) {
+		t.Fatalf("config after a bad one: %q", s)
+	}
+}
+
+func TestResolverHostServers(t *testing.T) {
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(resolvConfPath, []byte("# comment\nnameserver 192.0.2.53\nsearch example\nnameserver fd00::53\nnameserver bogus\n"), 0o644)
+	conf, err := parseResolverConfig(ResolverConfig{Servers: []string{HostResolver, "10.0.0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []string
+	for _, s := range conf.servers {
+		servers = append(servers, s.addr.String())
+		if s.system != (s.addr.Port() == 53 && s.addr.Addr() != netip.MustParseAddr("10.0.0.2")) {
+			t.Fatalf("server %s system %v", s.addr, s.system)
+		}
+	}
+	if !slices.Equal(servers, []string{"192.0.2.53:53", "[fd00::53]:53", "10.0.0.2:53"}) {
+		t.Fatalf("servers %q", servers)
+	}
+}
+
+func TestResolverNameList(t *testing.T) {
+	// the search names longer than 254 bytes are skipped
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("b", 60)
+	for _, tc := range []struct {
+		ndots int
+		name  string
+		want  []string
+	}{
+		{1, "www", []string{"www.corp.example.", "www.example.", "www."}},
+		{1, "www.test", []string{"www.test.", "www.test.corp.example.", "www.test.example."}},
+		{2, "www.test", []string{"www.test.corp.example.", "www.test.example.", "www.test."}},
+		{1, "www.test.", []string{"www.test."}},
+		{1, long, []string{long + "."}},
+	} {
+		conf, err := parseResolverConfig(ResolverConfig{Search: []string{"corp.example", "example"}, NDots: tc.ndots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conf.nameList(tc.name); !slices.Equal(got, tc.want) {
+			t.Errorf("ndots %d %s: %q, want %q", tc.ndots, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolverSearch(t *testing.T) {
+	g, up := resolverPair(t)
+	log := &queryLog{handle: zoneStandIn(
+		rr("www.corp.example.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}}),
+		rr("a.b.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 11}}),
+	)}
+	udpServer(t, up, "10.0.0.2:53", log.serve)
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}, Search: []string{"corp.example"}, NDots: 2, CacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		want    string
+		queried []string
+	}{
+		{"www", "192.0.2.10", []string{"www.corp.example."}},
+		{"a.b", "192.0.2.11", []string{"a.b.corp.example.", "a.b."}},
+	} {
+		log.reset(0)
+		addrs, err := g.LookupContextHost(context.Background(), tc.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !slices.Equal(addrs, []string{tc.want}) || !slices.Equal(log.queried(), tc.queried) {
+			t.Fatalf("%s: %q after querying %q, want %s after %q", tc.name, addrs, log.queried(), tc.want, tc.queried)
+		}
+	}
+	_, err := g.LookupContextHost(context.Background(), "nowhere")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("unknown name: %v", err)
+	}
+}
+
+func TestResolverAttempts(t *testing.T) {
+	g, up := resolverPair(t)
+	log := &queryLog{drop: 2, handle: dnsStandIn}
+	udpServer(t, up, "10.0.0.2:53", log.serve)
+
+	// each attempt waits for the timeout before the next one
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}, Timeout: 100 * time.Millisecond, Attempts: 3, CacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	addrs, err := g.LookupContextHost(context.Background(), "a.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(addrs, []string{"1.2.3.4"}) || len(log.queried()) != 3 {
+		t.Fatalf("%q after %d queries", addrs, len(log.queried()))
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("answered after %s", d)
+	}
+
+	// the attempts run out
+	log.reset(2)
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}, Timeout: 100 * time.Millisecond, Attempts: 2, CacheSize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.LookupContextHost(context.Background(), "a.example.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout || dnsErr.Server != "10.0.0.2:53" {
+		t.Fatalf("lookup with the attempts run out: %v", err)
+	}
+	if n := len(log.queried()); n != 2 {
+		t.Fatalf("%d queries for 2 attempts", n)
+	}
+}
+
+func TestResolverRotate(t *testing.T) {
+	g, up := resolverPair(t)
+	first, second := &queryLog{handle: dnsStandIn}, &queryLog{handle: dnsStandIn}
+	udpServer(t, up, "10.0.0.2:53", first.serve)
+	udpServer(t, up, "10.0.0.2:5353", second.serve)
+
+	for _, rotate := range []bool{false, true} {
+		first.reset(0)
+		second.reset(0)
+		if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2", "10.0.0.2:5353"}, Rotate: rotate, CacheSize: -1}); err != nil {
+			t.Fatal(err)
+		}
+		for range 4 {
+			if _, err := g.LookupContextHost(context.Background(), "a.example."); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := []int{4, 0}
+		if rotate {
+			want = []int{2, 2}
+		}
+		if got := []int{len(first.queried()), len(second.queried())}; !slices.Equal(got, want) {
+			t.Fatalf("rotate %v: queries %v, want %v", rotate, got, want)
+		}
+	}
+}
+
+func TestResolverHosts(t *testing.T) {
+	g, up := resolverPair(t)
+	log := &queryLog{handle: dnsStandIn}
+	udpServer(t, up, "10.0.0.2:53", log.serve)
+	if err := g.SetResolverConfig(ResolverConfig{
+		Servers: []string{"10.0.0.2"},
+		Hosts:   map[string][]netip.Addr{"Override.Example.": {netip.MustParseAddr("192.0.2.1")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"override.example", "OVERRIDE.example."} {
+		addrs, err := g.LookupContextHost(context.Background(), name)
+		if err != nil || !slices.Equal(addrs, []string{"192.0.2.1"}) {
+			t.Fatalf("%s: %q, %v", name, addrs, err)
+		}
+	}
+	if q := log.queried(); len(q) != 0 {
+		t.Fatalf("hosts entries queried: %q", q)
+	}
+	// the other names go to the servers
+	if addrs, err := g.LookupContextHost(context.Background(), "other.example."); err != nil || !slices.Equal(addrs, []string{"1.2.3.4"}) {
+		t.Fatalf("other name: %q, %v", addrs, err)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	g, up := resolverPair(t)
+	log := &queryLog{handle: dnsStandIn}
+	udpServer(t, up, "10.0.0.2:53", log.serve)
+	r := g.NewResolver()
+
+	// without servers the dials fail
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"https://10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupIP(ctx, "ip4", "a.example."); err == nil {
+		t.Fatal("resolved over https")
+	}
+
+	// the resolver follows the config set after its creation
+	if err := g.SetResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := r.LookupIP(ctx, "ip4", "a.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Fatalf("resolved %v", ips)
+	}
+	if q := log.queried(); !slices.Contains(q, "a.example.") {
+		t.Fatalf("stand-in queried for %q", q)
+	}
+}
+
+func TestResolverRules(t *testing.T) {
+	conf, err := parseResolverConfig(ResolverConfig{
+		Servers:  []string{"10.0.0.2"},
+		Timeout:  time.Second,
+		Attempts: 2,
+		Rules: []ResolverRule{
+			{Suffix: "corp.example", Servers: []string{"10.0.0.3"}},
+			{Suffix: "*.dev.corp.example.", Servers: []string{"10.0.0.4"}, Timeout: 50 * time.Millisecond, Attempts: 3},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the longest matching suffix wins, the rules inherit the defaults
+	for _, tc := range []struct {
+		name     string
+		server   string
+		timeout  time.Duration
+		attempts int
+	}{
+		{"a.dev.corp.example.", "10.0.0.4:53", 50 * time.Millisecond, 3},
+		{"dev.corp.example.", "10.0.0.4:53", 50 * time.Millisecond, 3},
+		{"A.CORP.Example.", "10.0.0.3:53", time.Second, 2},
+		{"corp.example.", "10.0.0.3:53", time.Second, 2},
+		{"xcorp.example.", "10.0.0.2:53", time.Second, 2},
+		{"example.", "10.0.0.2:53", time.Second, 2},
+	} {
+		set := conf.route(tc.name)
+		if len(set.servers) != 1 || set.servers[0].addr.String() != tc.server || set.timeout != tc.timeout || set.attempts != tc.attempts {
+			t.Errorf("%s: %v, %s, %d attempts, want %s, %s, %d", tc.name, set.servers, set.timeout, set.attempts, tc.server, tc.timeout, tc.attempts)
+		}
+	}
+
+	for _, r := range []ResolverRule{
+		{Suffix: "bad suffix", Servers: []string{"10.0.0.3"}},
+		{Suffix: "corp.example"},
+		{Suffix: "corp.example", Servers: []string{"10.0.0.3"}, Timeout: -time.Second},
+		{Suffix: "corp.example", Servers: []string{"10.0.0.3"}, Attempts: -1},
+		{Suffix: "corp.example", Servers: []string{"bogus"}},
+	} {
+		if _, err := parseResolverConfig(ResolverConfig{Rules: []ResolverRule{r}}); err == nil {
+			t.Errorf("rule %+v parsed", r)
+		}
+	}
+}
+
+func TestResolverRuleQueries(t *testing.T) {
+	g, up := resolverPair(t)
+	def, corp := &queryLog{handle: dnsStandIn}, &queryLog{drop: 1 << 30, handle: dnsStandIn}
+	udpServer(t, up, "10.0.0.2:53", def.serve)
+	udpServer(t, up, "10.0.0.2:5353", corp.serve) // never answers
+	if err := g.SetResolverConfig(ResolverConfig{
+		Servers: []string{"10.0.0.2"},
+		Rules: []ResolverRule{
+			{Suffix: "corp.example", Servers: []string{"10.0.0.2:5353"}, Timeout: 50 * time.Millisecond, Attempts: 3},
+		},
+		CacheSize: -1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := g.LookupContextHost(ctx, "www.example."); err != nil {
+		t.Fatal(err)
+	}
+	// the rule's timeout and attempts, not the default 5s and 2
+	start := time.Now()
+	_, err := g.LookupContextHost(ctx, "www.corp.example.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout || dnsErr.Server != "10.0.0.2:5353" {
+		t.Fatalf("lookup under the rule: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("failed after %s", d)
+	}
+	if q := corp.queried(); len(q) != 3 || q[0] != "www.corp.example." {
+		t.Fatalf("rule server queried for %q", q)
+	}
+	if q := def.queried(); !slices.Equal(q, []string{"www.example."}) {
+		t.Fatalf("default server queried for %q", q)
+	}
+}
+
+func TestResolverRuleHostResolver(t *testing.T) {
+	defer func(path string) { resolvConfPath = path }(resolvConfPath)
+	resolvConfPath = filepath.Join(t.TempDir(), "resolv.conf")
+	rules := []ResolverRule{{Suffix: "lan", Servers: []string{HostResolver}}}
+	servers := func() []string {
+		t.Helper()
+		conf, err := parseResolverConfig(ResolverConfig{Servers: []string{"10.0.0.2"}, Rules: rules})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, server := range conf.route("printer.lan.").servers {
+			if !server.system {
+				t.Fatalf("host server %s not dialed through the host", server.addr)
+			}
+			s = append(s, server.addr.String())
+		}
+		return s
+	}
+
+	os.WriteFile(resolvConfPath, []byte("nameserver 192.0.2.53\n"), 0o644)
+	if s := servers(); !slices.Equal(s, []string{"192.0.2.53:53"}) {
+		t.Fatalf("host servers %q", s)
+	}
+	// without a resolv.conf the local servers, like the stdlib
+	os.Remove(resolvConfPath)
+	if s := servers(); !slices.Equal(s, []string{"127.0.0.1:53", "[::1]:53"}) {
+		t.Fatalf("fallback servers %q", s)
+	}
+}
@@ -0,0 +1,119 @@
+package gvisor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+var _ net.Listener = (*tcpListener)(nil)
+
+// dialTCP is gonet.DialContextTCP with the endpoint options applied before
+// connecting
+func (g *_Gvisor) dialTCP(ctx context.Context, addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.TCPConn, error) {
+	var wq waiter.Queue
+	ep, tcpErr := g.Stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+	g.Options.setKeepalive(ep)
+
+	entry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	tcpErr = ep.Connect(addr)
+	if _, ok := tcpErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpErr = ep.LastError()
+	}
+	if tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "connect", Net: "tcp", Addr: toTCPAddr(addr), Err: errors.New(tcpErr.String())}
+	}
+	return gonet.NewTCPConn(&wq, ep), nil
+}
+
+// listenTCP listen on addr, accepted connections get the endpoint options
+func (g *_Gvisor) listenTCP(addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (net.Listener, error) {
+	l := &tcpListener{g: g, closeChan: make(chan struct{})}
+	ep, tcpErr := g.Stack.NewEndpoint(tcp.ProtocolNumber, pn, &l.wq)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+	if tcpErr = ep.Bind(addr); tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "tcp", Addr: toTCPAddr(addr), Err: errors.New(tcpErr.String())}
+	}
+	if tcpErr = ep.Listen(4096); tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: toTCPAddr(addr), Err: errors.New(tcpErr.String())}
+	}
+	l.ep = ep
+	return l, nil
+}
+
+type tcpListener struct {
+	g  *_Gvisor
+	ep tcpip.Endpoint
+	wq waiter.Queue
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	n, wq, tcpErr := l.ep.Accept(nil)
+	if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+		entry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+		l.wq.EventRegister(&entry)
+		defer l.wq.EventUnregister(&entry)
+		for {
+			n, wq, tcpErr = l.ep.Accept(nil)
+			if _, ok := tcpErr.(*tcpip.ErrWouldBlock); !ok {
+				break
+			}
+			select {
+			case <-l.closeChan:
+				return nil, net.ErrClosed
+			case <-notifyCh:
+			}
+		}
+	}
+	if tcpErr != nil {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: errors.New(tcpErr.String())}
+	}
+	l.g.Options.setKeepalive(n)
+	return gonet.NewTCPConn(wq, n), nil
+}
+
+func (l *tcpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		l.ep.Close()
+	})
+	return nil
+}
+
+func (l *tcpListener) Addr() net.Addr {
+	addr, err := l.ep.GetLocalAddress()
+	if err != nil {
+		return nil
+	}
+	return toTCPAddr(addr)
+}
+
+func toTCPAddr(addr tcpip.FullAddress) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)}
+}
@@ -0,0 +1,317 @@
+package gvisor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxIdleDNSConns = 4
+	dohContentType  = "application/dns-message"
+)
+
+// dnsServer an upstream server, plain UDP/TCP, DNS over TLS (RFC 7858) or
+// DNS over HTTPS (RFC 8484)
+type dnsServer struct {
+	scheme string // "", "tls" or "https"
+	addr   netip.AddrPort
+	host   string // tls server name and http host
+	path   string
+	system bool // dialed through the host network, see HostResolver
+}
+
+func (s dnsServer) String() string {
+	switch s.scheme {
+	case "tls":
+		return "tls://" + net.JoinHostPort(s.host, strconv.Itoa(int(s.addr.Port())))
+	case "https":
+		return s.url()
+	}
+	return s.addr.String()
+}
+
+func (s dnsServer) url() string {
+	return "https://" + net.JoinHostPort(s.host, strconv.Itoa(int(s.addr.Port()))) + s.path
+}
+
+// parseDNSServer parse "ip", "ip:port", "tls://host[:port]" or
+// "https://host[:port][/path]". a host name must be in the hosts table, the
+// upstreams are not resolved through themselves
+func parseDNSServer(s string, hosts map[string][]netip.Addr) (dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		addr, err := parseServer(s, 53)
+		return dnsServer{addr: addr}, err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return dnsServer{}, fmt.Errorf("invalid dns server %q: %w", s, err)
+	}
+	server := dnsServer{scheme: u.Scheme, host: u.Hostname(), path: u.EscapedPath()}
+	var port uint16
+	switch u.Scheme {
+	case "tls":
+		port = 853
+		if server.path != "" {
+			return dnsServer{}, fmt.Errorf("invalid dns server %q: tls takes no path", s)
+		}
+	case "https":
+		port = 443
+		if server.path == "" {
+			server.path = "/dns-query"
+		}
+	default:
+		return dnsServer{}, fmt.Errorf("invalid dns server %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if p := u.Port(); p != "" {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return dnsServer{}, fmt.Errorf("invalid dns server %q: bad port", s)
+		}
+		port = uint16(n)
+	}
+	addr, err := netip.ParseAddr(server.host)
+	if err != nil {
+		addrs := hosts[hostsKey(server.host)]
+		if len(addrs) == 0 {
+			return dnsServer{}, fmt.Errorf("invalid dns server %q: %s is not an ip address or a hosts entry", s, server.host)
+		}
+		addr = addrs[0]
+	}
+	server.addr = netip.AddrPortFrom(addr.Unmap(), port)
+	return server, nil
+}
+
+// dialServer connect to a plain server through the netstack, or through the
+// host network for the servers of the host resolver
+func (g *_Gvisor) dialServer(ctx context.Context, network string, server dnsServer) (net.Conn, error) {
+	if server.system {
+		var d net.Dialer
+		return d.DialContext(ctx, network, server.addr.String())
+	}
+	if network == "udp" {
+		c, err := g.DialUDPAddrPort(netip.AddrPort{}, server.addr)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c, err := g.DialContextTCPAddrPort(ctx, server.addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// upstreams the connections kept to the encrypted servers of a resolver
+// config, closed when the config is replaced and its exchanges in flight are
+// done
+type upstreams struct {
+	mu      sync.Mutex
+	active  int // exchanges in flight
+	retired bool
+	idle    map[string][]*tls.Conn
+	clients map[string]*http.Client
+}
+
+// acquire hold the connections for an exchange
+func (u *upstreams) acquire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.active++
+}
+
+// release end an exchange, the last one closes the retired connections
+func (u *upstreams) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.active--
+	if u.retired && u.active == 0 {
+		u.closeLocked()
+	}
+}
+
+// retire close the connections once the exchanges in flight are done
+func (u *upstreams) retire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.retired = true
+	if u.active == 0 {
+		u.closeLocked()
+	}
+}
+
+// getIdle take an idle DoT connection to server
+func (u *upstreams) getIdle(server dnsServer) *tls.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conns := u.idle[server.String()]
+	if len(conns) == 0 {
+		return nil
+	}
+	c := conns[len(conns)-1]
+	u.idle[server.String()] = conns[:len(conns)-1]
+	return c
+}
+
+// putIdle keep c for the next query to server
+func (u *upstreams) putIdle(server dnsServer, c *tls.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle[server.String()]) >= maxIdleDNSConns {
+		c.Close()
+		return
+	}
+	if u.idle == nil {
+		u.idle = make(map[string][]*tls.Conn)
+	}
+	u.idle[server.String()] = append(u.idle[server.String()], c)
+}
+
+// client the DoH client of server, its transport keeps the connections alive
+func (u *upstreams) client(g *_Gvisor, conf *resolverConf, server dnsServer) *http.Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.clients[server.String()]; ok {
+		return c
+	}
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return g.DialContextTCPAddrPort(ctx, server.addr)
+		},
+		TLSClientConfig:     conf.tlsConfig(server),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleDNSConns,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+	if u.clients == nil {
+		u.clients = make(map[string]*http.Client)
+	}
+	u.clients[server.String()] = c
+	return c
+}
+
+func (u *upstreams) closeLocked() {
+	for _, conns := range u.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	for _, c := range u.clients {
+		c.CloseIdleConnections()
+	}
+	u.idle, u.clients = nil, nil
+}
+
+func (conf *resolverConf) tlsConfig(server dnsServer) *tls.Config {
+	cfg := conf.cfg.TLSConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = server.host
+	}
+	return cfg
+}
+
+// dialTLS connect to a DoT server through the netstack
+func (g *_Gvisor) dialTLS(ctx context.Context, conf *resolverConf, server dnsServer) (*tls.Conn, error) {
+	raw, err := g.DialContextTCPAddrPort(ctx, server.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := tls.Client(raw, conf.tlsConfig(server))
+	if err := c.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// exchangeTLS send q over an idle or a new DoT connection, a failed idle
+// connection is retried once on a new one
+func (g *_Gvisor) exchangeTLS(ctx context.Context, conf *resolverConf, server dnsServer, q dnsmessage.Question, timeout time.Duration) ([]byte, error) {
+	id, _, tcpReq, err := newRequest(q)
+	if err != nil {
+		return nil, errCannotMarshalDNSMessage
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conf.upstreams.acquire()
+	defer conf.upstreams.release()
+	for {
+		c := conf.upstreams.getIdle(server)
+		reused := c != nil
+		if !reused {
+			if c, err = g.dialTLS(ctx, conf, server); err != nil {
+				return nil, err
+			}
+		}
+		if d, ok := ctx.Deadline(); ok {
+			c.SetDeadline(d)
+		}
+		msg, err := dnsStreamRoundTrip(c, id, q, tcpReq)
+		if err != nil {
+			c.Close()
+			if reused && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		conf.upstreams.putIdle(server, c)
+		return msg, nil
+	}
+}
+
+// exchangeHTTPS POST q to a DoH server
+func (g *_Gvisor) exchangeHTTPS(ctx context.Context, conf *resolverConf, server dnsServer, q dnsmessage.Question, timeout time.Duration) ([]byte, error) {
+	id, udpReq, _, err := newRequest(q)
+	if err != nil {
+		return nil, errCannotMarshalDNSMessage
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conf.upstreams.acquire()
+	defer conf.upstreams.release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.url(), bytes.NewReader(udpReq))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := conf.upstreams.client(g, conf, server).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: http status %s", errServerMisbehaving, resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, errCannotUnmarshalDNSMessage
+	}
+	respQ, err := p.Question()
+	if err != nil || !checkResponse(id, q, h, respQ) {
+		return nil, errInvalidDNSResponse
+	}
+	return msg, nil
+}
@@ -0,0 +1,207 @@
+package gvisor
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStandIn answer A queries with 1.2.3.4 and the others with NXDOMAIN
+func dnsStandIn(req []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+	msg.Additionals = nil
+	if q.Type == dnsmessage.TypeA {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+		}}
+	} else {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	}
+	out, _ := msg.Pack()
+	return out
+}
+
+// testCert a self signed certificate for dns.test and 10.0.0.2
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.2")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(c)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// dotStandIn serve DNS over TLS on l, closed counts the connections closed by
+// the client
+func dotStandIn(l net.Listener, conns, closed *atomic.Int32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer closed.Add(1)
+			defer c.Close()
+			r := bufio.NewReader(c)
+			for {
+				var n uint16
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+					return
+				}
+				req := make([]byte, n)
+				if _, err := io.ReadFull(r, req); err != nil {
+					return
+				}
+				resp := dnsStandIn(req)
+				if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	client := create(t, "10.0.0.1/24")
+	server := create(t, "10.0.0.2/24")
+	link(t, client, server)
+	crt, roots := testCert(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{crt}}
+
+	dl, err := server.Listen("tcp4", 853)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dl.Close() })
+	var dotConns, dotClosed atomic.Int32
+	go dotStandIn(tls.NewListener(dl, tlsConfig), &dotConns, &dotClosed)
+
+	hl, err := server.Listen("tcp4", 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	hs := &http.Server{TLSConfig: tlsConfig, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(dnsStandIn(body))
+	})}
+	go hs.ServeTLS(hl, "", "")
+	t.Cleanup(func() { hs.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lookup := func(host string) ([]string, error) {
+		return client.LookupContextHost(ctx, host)
+	}
+
+	// DoT: the connection is kept for the next queries
+	err = client.SetResolverConfig(ResolverConfig{Servers: []string{"tls://10.0.0.2"}, CacheSize: -1, TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		addrs, err := lookup(host)
+		if err != nil {
+			t.Fatalf("dot lookup %s: %v", host, err)
+		}
+		if !slices.Equal(addrs, []string{"1.2.3.4"}) {
+			t.Fatalf("dot lookup %s: %v", host, addrs)
+		}
+	}
+	if n := dotConns.Load(); n != 1 {
+		t.Fatalf("dot used %d connections, want 1", n)
+	}
+
+	// the certificate is verified against the server name
+	err = client.SetResolverConfig(ResolverConfig{
+		Servers:  []string{"tls://dns.test"},
+		Attempts: 1,
+		Hosts:    map[string][]netip.Addr{"dns.test": {netip.MustParseAddr("10.0.0.2")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookup("d.example.com"); err == nil {
+		t.Fatal("dot lookup with an untrusted certificate succeeded")
+	}
+	// the idle connection of the replaced config is closed
+	for deadline := time.Now().Add(5 * time.Second); dotClosed.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("idle dot connection of the old config still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// DoH with the default path, NXDOMAIN is reported as not found
+	err = client.SetResolverConfig(ResolverConfig{
+		Servers:   []string{"https://dns.test"},
+		CacheSize: -1,
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Hosts:     map[string][]netip.Addr{"dns.test": {netip.MustParseAddr("10.0.0.2")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := lookup("e.example.com")
+	if err != nil {
+		t.Fatalf("doh lookup: %v", err)
+	}
+	if !slices.Equal(addrs, []string{"1.2.3.4"}) {
+		t.Fatalf("doh lookup: %v", addrs)
+	}
+	if len(paths) == 0 || paths[0] != "/dns-query" {
+		t.Fatalf("doh paths %v", paths)
+	}
+	_, err = client.LookupContextMX(ctx, "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("doh nxdomain: %v", err)
+	}
+}
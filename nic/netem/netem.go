@@ -0,0 +1,265 @@
+package netem
+
+import (
+	"cmp"
+	"container/heap"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+var _ nic.Handler = (*Emulator)(nil)
+
+// Impairment of one direction
+type Impairment struct {
+	// Latency added to every packet
+	Latency time.Duration
+	// Jitter random latency variation in [-Jitter, Jitter]
+	Jitter time.Duration
+	// Loss random loss probability in [0, 1]
+	Loss float64
+	// Burst bursty loss, on top of Loss. its state steps with every packet
+	Burst *GilbertElliott
+	// Duplicate probability a packet is sent twice
+	Duplicate float64
+	// Reorder probability a packet skips the latency and overtakes the queue
+	Reorder float64
+	// Rate bandwidth cap in bytes per second, 0 means unlimited
+	Rate int64
+	// QueueLimit max packets in flight, extra packets are dropped. default 1000
+	QueueLimit int
+}
+
+func (imp *Impairment) zero() bool {
+	return imp.Latency == 0 && imp.Jitter == 0 && imp.Loss == 0 && imp.Burst == nil &&
+		imp.Duplicate == 0 && imp.Reorder == 0 && imp.Rate == 0
+}
+
+// GilbertElliott two-state bursty loss model. the channel moves from good to
+// bad state with probability P and back with probability R for each packet.
+// a simple Gilbert model is LossGood=0, LossBad=1
+type GilbertElliott struct {
+	P, R              float64
+	LossGood, LossBad float64
+}
+
+// Emulator is a nic.Handler emulating a bad link, use it in a nic.Chain or
+// wrap a NIC with Wrap. the random decisions are reproducible with the same Seed
+type Emulator struct {
+	Inbound, Outbound Impairment
+	Seed              uint64
+
+	mu        sync.Mutex
+	initOnce  sync.Once
+	state     [2]*dirState
+	queue     packetQueue
+	seq       uint64
+	wakeup    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type dirState struct {
+	rng      *rand.Rand
+	bad      bool
+	nextFree time.Time
+	inflight int
+}
+
+type scheduled struct {
+	at  time.Time
+	seq uint64
+	dir nic.Direction
+	inj nic.Injector
+	p   *nic.Packet
+}
+
+func (e *Emulator) init() {
+	e.initOnce.Do(func() {
+		e.state[0] = &dirState{rng: rand.New(rand.NewPCG(e.Seed, 1))}
+		e.state[1] = &dirState{rng: rand.New(rand.NewPCG(e.Seed, 2))}
+		e.wakeup = make(chan struct{}, 1)
+		e.closed = make(chan struct{})
+		go e.run()
+	})
+}
+
+// SetImpairment change the impairment of a direction at runtime
+func (e *Emulator) SetImpairment(dir nic.Direction, imp Impairment) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if dir == nic.Inbound {
+		e.Inbound = imp
+	} else {
+		e.Outbound = imp
+	}
+}
+
+func (e *Emulator) HandlePacket(dir nic.Direction, p *nic.Packet, inj nic.Injector) nic.Verdict {
+	e.init()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	imp, st := &e.Outbound, e.state[1]
+	if dir == nic.Inbound {
+		imp, st = &e.Inbound, e.state[0]
+	}
+	if imp.zero() {
+		return nic.Pass
+	}
+	select {
+	case <-e.closed:
+		return nic.Pass
+	default:
+	}
+	lost := imp.Loss > 0 && st.rng.Float64() < imp.Loss
+	if ge := imp.Burst; ge != nil {
+		// the state steps for every packet, the ones lost above too
+		if st.bad {
+			st.bad = st.rng.Float64() >= ge.R
+		} else {
+			st.bad = st.rng.Float64() < ge.P
+		}
+		loss := ge.LossGood
+		if st.bad {
+			loss = ge.LossBad
+		}
+		if loss > 0 && st.rng.Float64() < loss {
+			lost = true
+		}
+	}
+	if lost {
+		return nic.Drop
+	}
+	copies := 1
+	if imp.Duplicate > 0 && st.rng.Float64() < imp.Duplicate {
+		copies = 2
+	}
+	now := time.Now()
+	for range copies {
+		if st.inflight >= cmp.Or(imp.QueueLimit, 1000) {
+			break
+		}
+		at := now
+		if imp.Rate > 0 {
+			st.nextFree = maxTime(st.nextFree, now).Add(time.Duration(int64(len(p.AsBytes())) * int64(time.Second) / imp.Rate))
+			at = st.nextFree
+		}
+		if imp.Reorder == 0 || st.rng.Float64() >= imp.Reorder {
+			delay := imp.Latency
+			if imp.Jitter > 0 {
+				delay += time.Duration(st.rng.Int64N(int64(2*imp.Jitter)+1)) - imp.Jitter
+			}
+			at = at.Add(max(delay, 0))
+		}
+		cp := p.Clone()
+		st.inflight++
+		e.seq++
+		heap.Push(&e.queue, &scheduled{at: at, seq: e.seq, dir: dir, inj: inj, p: cp})
+	}
+	select {
+	case e.wakeup <- struct{}{}:
+	default:
+	}
+	return nic.Drop
+}
+
+func (e *Emulator) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		e.mu.Lock()
+		var due []*scheduled
+		now := time.Now()
+		for e.queue.Len() > 0 && !e.queue[0].at.After(now) {
+			s := heap.Pop(&e.queue).(*scheduled)
+			e.stateOf(s.dir).inflight--
+			due = append(due, s)
+		}
+		wait := time.Hour
+		if e.queue.Len() > 0 {
+			wait = e.queue[0].at.Sub(now)
+		}
+		e.mu.Unlock()
+
+		for _, s := range due {
+			s.inj.Inject(s.dir, s.p)
+		}
+		timer.Reset(wait)
+		select {
+		case <-e.closed:
+			return
+		case <-e.wakeup:
+		case <-timer.C:
+		}
+	}
+}
+
+func (e *Emulator) stateOf(dir nic.Direction) *dirState {
+	if dir == nic.Inbound {
+		return e.state[0]
+	}
+	return e.state[1]
+}
+
+// Close stop the emulator and drop all delayed packets
+func (e *Emulator) Close() error {
+	e.init()
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for _, s := range e.queue {
+			s.p.Release()
+		}
+		e.queue = nil
+	})
+	return nil
+}
+
+// Wrap wrap n with the emulator, closing the returned NIC closes both
+func Wrap(n nic.NIC, e *Emulator) nic.NIC {
+	c := &emulatedNIC{Chain: &nic.Chain{NIC: n}, e: e}
+	c.Use(e)
+	return c
+}
+
+type emulatedNIC struct {
+	*nic.Chain
+	e *Emulator
+}
+
+func (n *emulatedNIC) Close() error {
+	n.e.Close()
+	return n.Chain.Close()
+}
+
+type packetQueue []*scheduled
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x any) { *q = append(*q, x.(*scheduled)) }
+
+func (q *packetQueue) Pop() any {
+	old := *q
+	s := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return s
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,222 @@
+package netem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/gvisor"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+// pattern the copies scheduled for each of n packets, the latency keeps them
+// all queued
+func pattern(imp Impairment, seed uint64, n int) []int {
+	imp.Latency, imp.QueueLimit = time.Hour, 2*n
+	e := &Emulator{Outbound: imp, Seed: seed}
+	defer e.Close()
+	copies := make([]int, n)
+	for i := range copies {
+		p := nic.IPPacketPool.Get()
+		p.Write(make([]byte, 100))
+		e.mu.Lock()
+		before := e.queue.Len()
+		e.mu.Unlock()
+		e.HandlePacket(nic.Outbound, p, nil)
+		p.Release()
+		e.mu.Lock()
+		copies[i] = e.queue.Len() - before
+		e.mu.Unlock()
+	}
+	return copies
+}
+
+func TestSeed(t *testing.T) {
+	imp := Impairment{Loss: 0.2, Duplicate: 0.1, Burst: &GilbertElliott{P: 0.05, R: 0.3, LossBad: 1}}
+	a, b := pattern(imp, 7, 1000), pattern(imp, 7, 1000)
+	if !slices.Equal(a, b) {
+		t.Fatal("same seed, different decisions")
+	}
+	if slices.Equal(a, pattern(imp, 8, 1000)) {
+		t.Fatal("other seed, same decisions")
+	}
+}
+
+// TestBurstSteps the bursts of the Gilbert-Elliott model keep their length
+// when Loss drops packets too: the state steps for every packet
+func TestBurstSteps(t *testing.T) {
+	const r = 0.01 // bursts of 1/r packets on average
+	copies := pattern(Impairment{Loss: 0.5, Burst: &GilbertElliott{P: 0.01, R: r, LossBad: 1}}, 1, 100000)
+	var bursts, lost int
+	run := 0
+	for _, c := range append(copies, 1) {
+		if c == 0 {
+			run++
+			continue
+		}
+		if run >= 20 { // the random losses of Loss are rarely that long
+			bursts++
+			lost += run
+		}
+		run = 0
+	}
+	if bursts == 0 {
+		t.Fatal("no burst")
+	}
+	if mean := float64(lost) / float64(bursts); mean < 0.6/r || mean > 1.5/r {
+		t.Fatalf("mean burst of %.0f packets, want about %.0f", mean, 1/r)
+	}
+}
+
+// link a pipe whose a side is wrapped with the emulator
+func link(t *testing.T, e *Emulator) (a, b nic.NIC) {
+	t.Helper()
+	pa, pb := pipe.New(pipe.Config{MTU: 1500})
+	a = Wrap(pa, e)
+	t.Cleanup(func() {
+		a.Close()
+		pb.Close()
+	})
+	return a, pb
+}
+
+func send(t *testing.T, n nic.NIC, size int) {
+	t.Helper()
+	p := nic.IPPacketPool.Get()
+	defer p.Release()
+	p.Write(make([]byte, size))
+	if err := n.Write(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive read packets until none comes for wait
+func receive(n nic.NIC, wait time.Duration) int {
+	count := 0
+	for {
+		nic.SetReadDeadline(n, time.Now().Add(wait))
+		p, err := n.Read()
+		if err != nil {
+			return count
+		}
+		p.Release()
+		count++
+	}
+}
+
+func TestPipeImpairments(t *testing.T) {
+	t.Run("latency", func(t *testing.T) {
+		a, b := link(t, &Emulator{Outbound: Impairment{Latency: 50 * time.Millisecond}})
+		start := time.Now()
+		send(t, a, 100)
+		nic.SetReadDeadline(b, start.Add(time.Second))
+		p, err := b.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Fatalf("delivered after %s", d)
+		}
+	})
+	t.Run("loss", func(t *testing.T) {
+		a, b := link(t, &Emulator{Outbound: Impairment{Loss: 0.5}, Seed: 1})
+		for range 1000 {
+			send(t, a, 100)
+		}
+		if n := receive(b, 100*time.Millisecond); n < 400 || n > 600 {
+			t.Fatalf("%d of 1000 packets delivered", n)
+		}
+	})
+	t.Run("rate", func(t *testing.T) {
+		// 10 packets of 1000 bytes at 100kB/s take 100ms
+		a, b := link(t, &Emulator{Outbound: Impairment{Rate: 100000}})
+		start := time.Now()
+		for range 10 {
+			send(t, a, 1000)
+		}
+		nic.SetReadDeadline(b, start.Add(time.Second))
+		for range 10 {
+			p, err := b.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Release()
+		}
+		if d := time.Since(start); d < 90*time.Millisecond {
+			t.Fatalf("10kB at 100kB/s delivered in %s", d)
+		}
+	})
+	t.Run("inbound", func(t *testing.T) {
+		a, b := link(t, &Emulator{Inbound: Impairment{Loss: 1}})
+		send(t, b, 100)
+		nic.SetReadDeadline(a, time.Now().Add(50*time.Millisecond))
+		if _, err := a.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("read with full inbound loss: %v", err)
+		}
+	})
+}
+
+// TestTCPImpaired gVisor TCP recovers from loss, duplicates and reordering
+func TestTCPImpaired(t *testing.T) {
+	bad := Impairment{Latency: 2 * time.Millisecond, Jitter: time.Millisecond, Loss: 0.02, Duplicate: 0.01, Reorder: 0.01}
+	a, b := link(t, &Emulator{Inbound: bad, Outbound: bad, Seed: 1})
+	g1, err := gvisor.Create(nic.Config{MTU: 1500, IPv4: "10.0.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g1.Close()
+	g2, err := gvisor.Create(nic.Config{MTU: 1500, IPv4: "10.0.0.2/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	for _, br := range []*nic.Bridge{{A: g1, B: a}, {A: g2, B: b}} {
+		go func() { done <- br.Run(ctx) }()
+	}
+	defer func() {
+		cancel()
+		<-done
+		<-done
+	}()
+
+	l, err := g2.Listen("tcp4", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(data)
+		c.Close()
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer dialCancel()
+	c, err := g1.DialContextTCPAddrPort(dialCtx, netip.MustParseAddrPort("10.0.0.2:8080"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data))
+	}
+}
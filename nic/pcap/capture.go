@@ -0,0 +1,250 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+var (
+	_ nic.BatchNIC    = (*Capture)(nil)
+	_ nic.DeadlineNIC = (*Capture)(nil)
+)
+
+var ErrCaptureRunning = errors.New("capture already running")
+
+// Capture wraps a nic.NIC and writes every packet passing through Read/Write
+// to a pcapng stream. capture can be started and stopped at runtime
+type Capture struct {
+	nic.NIC
+	// Name is written as the pcapng interface name
+	Name string
+	// Snaplen max bytes saved per packet, 0 means no limit
+	Snaplen int
+
+	filter  atomic.Pointer[Filter]
+	session atomic.Pointer[session]
+	mu      sync.Mutex
+}
+
+type session struct {
+	mu     sync.Mutex
+	w      packetWriter
+	closed bool
+}
+
+type packetWriter interface {
+	WritePacket(ts time.Time, dir Direction, data []byte) error
+	io.Closer
+}
+
+// SetFilter set the capture filter expression, it takes effect immediately
+func (c *Capture) SetFilter(expr string) error {
+	f, err := CompileFilter(expr)
+	if err != nil {
+		return err
+	}
+	c.filter.Store(f)
+	return nil
+}
+
+// Start start capture into w. w is not closed by Stop
+func (c *Capture) Start(w io.Writer) error {
+	return c.start(&streamWriter{Writer: NewWriter(w, c.Name, c.Snaplen)})
+}
+
+// StartFile start capture into a ring buffer of files. a new file is opened
+// when the current one exceeds maxSize bytes, at most maxFiles files are kept.
+// maxSize <= 0 disables rotation
+func (c *Capture) StartFile(path string, maxSize int64, maxFiles int) error {
+	rw := &ringWriter{path: path, maxSize: maxSize, maxFiles: max(maxFiles, 1), ifName: c.Name, snaplen: c.Snaplen}
+	if err := rw.rotate(); err != nil {
+		return err
+	}
+	if err := c.start(rw); err != nil {
+		rw.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *Capture) start(w packetWriter) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session.Load() != nil {
+		return ErrCaptureRunning
+	}
+	c.session.Store(&session{w: w})
+	return nil
+}
+
+// Stop stop the running capture
+func (c *Capture) Stop() error {
+	return c.stop(nil)
+}
+
+// stop the running capture, only when it is s if s is not nil
+func (c *Capture) stop(s *session) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == nil {
+		s = c.session.Load()
+	}
+	if s == nil || !c.session.CompareAndSwap(s, nil) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.w.Close()
+}
+
+// Capturing report whether a capture is running
+func (c *Capture) Capturing() bool {
+	return c.session.Load() != nil
+}
+
+func (c *Capture) capture(dir Direction, p *nic.Packet) {
+	s := c.session.Load()
+	if s == nil {
+		return
+	}
+	data := p.AsBytes()
+	if !c.filter.Load().Match(dir, data) {
+		return
+	}
+	ts := p.Meta().Time
+	if dir == DirOut || ts.IsZero() {
+		ts = time.Now()
+	}
+	// a concurrent Stop may have closed the writer since the load
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	err := s.w.WritePacket(ts, dir, data)
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("[Capture] Write packet, capture stopped", "err", err)
+		c.stop(s)
+	}
+}
+
+func (c *Capture) Read() (*nic.Packet, error) {
+	p, err := c.NIC.Read()
+	if err != nil {
+		return p, err
+	}
+	c.capture(DirIn, p)
+	return p, nil
+}
+
+func (c *Capture) ReadContext(ctx context.Context) (*nic.Packet, error) {
+	p, err := nic.ReadContext(ctx, c.NIC)
+	if err != nil {
+		return p, err
+	}
+	c.capture(DirIn, p)
+	return p, nil
+}
+
+func (c *Capture) SetReadDeadline(t time.Time) error {
+	return nic.SetReadDeadline(c.NIC, t)
+}
+
+func (c *Capture) ReadDeadline() time.Time {
+	return nic.ReadDeadline(c.NIC)
+}
+
+func (c *Capture) Write(p *nic.Packet) error {
+	c.capture(DirOut, p)
+	return c.NIC.Write(p)
+}
+
+func (c *Capture) ReadBatch(pkts []*nic.Packet) (int, error) {
+	n, err := nic.ReadBatch(c.NIC, pkts)
+	for _, p := range pkts[:n] {
+		c.capture(DirIn, p)
+	}
+	return n, err
+}
+
+func (c *Capture) WriteBatch(pkts []*nic.Packet) (int, error) {
+	for _, p := range pkts {
+		c.capture(DirOut, p)
+	}
+	return nic.WriteBatch(c.NIC, pkts)
+}
+
+func (c *Capture) Close() error {
+	c.Stop()
+	return c.NIC.Close()
+}
+
+type streamWriter struct {
+	*Writer
+}
+
+func (w *streamWriter) Close() error {
+	return nil
+}
+
+type ringWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	ifName   string
+	snaplen  int
+
+	index int
+	file  *os.File
+	w     *Writer
+}
+
+func (rw *ringWriter) filename(index int) string {
+	if rw.maxSize <= 0 {
+		return rw.path
+	}
+	ext := filepath.Ext(rw.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(rw.path, ext), index%rw.maxFiles, ext)
+}
+
+func (rw *ringWriter) rotate() error {
+	if rw.file != nil {
+		if err := rw.file.Close(); err != nil {
+			return err
+		}
+		rw.index++
+	}
+	f, err := os.Create(rw.filename(rw.index))
+	if err != nil {
+		return fmt.Errorf("create capture file: %w", err)
+	}
+	rw.file = f
+	rw.w = NewWriter(f, rw.ifName, rw.snaplen)
+	return nil
+}
+
+func (rw *ringWriter) WritePacket(ts time.Time, dir Direction, data []byte) error {
+	if rw.maxSize > 0 && rw.w.Written() >= rw.maxSize {
+		if err := rw.rotate(); err != nil {
+			return err
+		}
+	}
+	return rw.w.WritePacket(ts, dir, data)
+}
+
+func (rw *ringWriter) Close() error {
+	return rw.file.Close()
+}
@@ -0,0 +1,156 @@
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+func writePacket(t *testing.T, n nic.NIC, data []byte) {
+	t.Helper()
+	p := nic.IPPacketPool.Get()
+	defer p.Release()
+	p.Write(data)
+	if err := n.Write(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	c := &Capture{NIC: a, Name: "test0", Snaplen: 32}
+	defer c.Close()
+	if err := c.SetFilter("udp"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.Start(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(io.Discard); err != ErrCaptureRunning {
+		t.Fatalf("second start: %v", err)
+	}
+
+	out := ipPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 100)
+	in := ipPacket(protoUDP, "10.0.0.2", "10.0.0.1", 53, 1000, 20)
+	before := time.Now()
+	writePacket(t, c, out)
+	writePacket(t, c, ipPacket(protoTCP, "10.0.0.1", "10.0.0.2", 1000, 80, 40)) // filtered
+	p, err := b.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	writePacket(t, b, in)
+	p, err = c.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := p.Meta().Time
+	p.Release()
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Capturing() {
+		t.Fatal("capturing after stop")
+	}
+	writePacket(t, c, out) // not captured
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		dir  Direction
+		data []byte
+	}{{DirOut, out[:32]}, {DirIn, in}} {
+		ts, dir, data, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dir != want.dir || !bytes.Equal(data, want.data) {
+			t.Fatalf("read %s % x, want %s % x", dir, data, want.dir, want.data)
+		}
+		if ts.Before(before) || ts.After(time.Now()) {
+			t.Fatalf("%s packet at %v", dir, ts)
+		}
+		// a read packet keeps the time it was received
+		if dir == DirIn && !ts.Equal(received) {
+			t.Fatalf("in packet at %v, received at %v", ts, received)
+		}
+	}
+	if r.Snaplen() != 32 {
+		t.Fatalf("snaplen %d", r.Snaplen())
+	}
+	if _, _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("read after the last packet: %v", err)
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	defer b.Close()
+	c := &Capture{NIC: a}
+	defer c.Close()
+	dir := t.TempDir()
+	if err := c.StartFile(filepath.Join(dir, "cap.pcapng"), 1000, 3); err != nil {
+		t.Fatal(err)
+	}
+	data := ipPacket(protoUDP, "10.0.0.1", "10.0.0.2", 1000, 53, 200)
+	for range 50 {
+		writePacket(t, c, data)
+		p, err := b.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("kept %v, want 3 files", files)
+	}
+	total := 0
+	for _, name := range files {
+		if filepath.Ext(name) != ".pcapng" {
+			t.Fatalf("file %s", name)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for {
+			_, _, got, err := r.ReadPacket()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s: read % x", name, got)
+			}
+			total++
+		}
+		f.Close()
+	}
+	if total == 0 || total >= 50 {
+		t.Fatalf("%d packets kept of 50", total)
+	}
+}
@@ -0,0 +1,405 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Filter is a compiled BPF-like filter expression.
+//
+// Supported primitives:
+//
+//	ip, ip4, ip6, tcp, udp, icmp, icmp6, proto N
+//	[src|dst] host ADDR, [src|dst] net CIDR
+//	[src|dst] port N, [src|dst] portrange N-M
+//	in, out, less N, greater N
+//
+// primitives can be combined with and(&&), or(||), not(!) and parentheses.
+// a protocol followed by a port primitive means both, eg: "tcp dst port 80"
+type Filter struct {
+	expr string
+	root node
+}
+
+// CompileFilter compile the filter expression. an empty expression matches everything
+func CompileFilter(expr string) (*Filter, error) {
+	p := &parser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return &Filter{expr: expr, root: matchAll{}}, nil
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("compile filter %q: %w", expr, err)
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("compile filter %q: unexpected %q", expr, tok)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match report whether the ip packet matches the filter
+func (f *Filter) Match(dir Direction, pkt []byte) bool {
+	if f == nil {
+		return true
+	}
+	var info packetInfo
+	info.parse(pkt)
+	info.dir = dir
+	return f.root.match(&info)
+}
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+type packetInfo struct {
+	dir      Direction
+	ver      uint8
+	proto    uint8
+	src, dst netip.Addr
+	hasPorts bool
+	sport    uint16
+	dport    uint16
+	length   int
+}
+
+func (info *packetInfo) parse(pkt []byte) {
+	info.length = len(pkt)
+	if len(pkt) == 0 {
+		return
+	}
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return
+		}
+		info.ver = 4
+		info.proto = pkt[9]
+		info.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		info.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 { // not the first fragment
+			return
+		}
+		payload = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 {
+			return
+		}
+		info.ver = 6
+		info.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		info.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		next, off := pkt[6], 40
+	ext:
+		for off+8 <= len(pkt) {
+			switch next {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				next, off = pkt[off], off+(int(pkt[off+1])+1)*8
+			case 44: // fragment
+				if binary.BigEndian.Uint16(pkt[off+2:off+4])&0xfff8 != 0 {
+					info.proto = pkt[off]
+					return
+				}
+				next, off = pkt[off], off+8
+			default:
+				break ext
+			}
+		}
+		info.proto = next
+		if off > len(pkt) {
+			return
+		}
+		payload = pkt[off:]
+	default:
+		return
+	}
+	if (info.proto == protoTCP || info.proto == protoUDP) && len(payload) >= 4 {
+		info.hasPorts = true
+		info.sport = binary.BigEndian.Uint16(payload[0:2])
+		info.dport = binary.BigEndian.Uint16(payload[2:4])
+	}
+}
+
+type node interface {
+	match(*packetInfo) bool
+}
+
+type matchAll struct{}
+
+func (matchAll) match(*packetInfo) bool { return true }
+
+type andNode struct{ l, r node }
+
+func (n andNode) match(info *packetInfo) bool { return n.l.match(info) && n.r.match(info) }
+
+type orNode struct{ l, r node }
+
+func (n orNode) match(info *packetInfo) bool { return n.l.match(info) || n.r.match(info) }
+
+type notNode struct{ n node }
+
+func (n notNode) match(info *packetInfo) bool { return !n.n.match(info) }
+
+type funcNode func(*packetInfo) bool
+
+func (f funcNode) match(info *packetInfo) bool { return f(info) }
+
+const (
+	qualAny = iota
+	qualSrc
+	qualDst
+)
+
+func matchAddr(qual int, info *packetInfo, f func(netip.Addr) bool) bool {
+	if info.ver == 0 {
+		return false
+	}
+	switch qual {
+	case qualSrc:
+		return f(info.src)
+	case qualDst:
+		return f(info.dst)
+	}
+	return f(info.src) || f(info.dst)
+}
+
+func matchPort(qual int, info *packetInfo, lo, hi uint16) bool {
+	if !info.hasPorts {
+		return false
+	}
+	in := func(p uint16) bool { return p >= lo && p <= hi }
+	switch qual {
+	case qualSrc:
+		return in(info.sport)
+	case qualDst:
+		return in(info.dport)
+	}
+	return in(info.sport) || in(info.dport)
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && (i+1 >= len(expr) || expr[i+1] != '='):
+			flush()
+			tokens = append(tokens, "!")
+		case (c == '&' || c == '|') && i+1 < len(expr) && expr[i+1] == c:
+			flush()
+			tokens = append(tokens, expr[i:i+2])
+			i++
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok == "or" || tok == "||"; tok = p.peek() {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok == "and" || tok == "&&"; tok = p.peek() {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if tok := p.peek(); tok == "not" || tok == "!" {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	case "ip", "ip4":
+		return funcNode(func(info *packetInfo) bool { return info.ver == 4 }), nil
+	case "ip6":
+		return funcNode(func(info *packetInfo) bool { return info.ver == 6 }), nil
+	case "tcp", "udp", "icmp", "icmp6":
+		proto := map[string]uint8{"tcp": protoTCP, "udp": protoUDP, "icmp": protoICMP, "icmp6": protoICMPv6}[tok]
+		n := node(funcNode(func(info *packetInfo) bool { return info.ver != 0 && info.proto == proto }))
+		switch p.peek() {
+		case "src", "dst", "port", "portrange":
+			r, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			n = andNode{n, r}
+		}
+		return n, nil
+	case "proto":
+		v, err := p.number(255)
+		if err != nil {
+			return nil, err
+		}
+		return funcNode(func(info *packetInfo) bool { return info.ver != 0 && info.proto == uint8(v) }), nil
+	case "in", "inbound":
+		return funcNode(func(info *packetInfo) bool { return info.dir == DirIn }), nil
+	case "out", "outbound":
+		return funcNode(func(info *packetInfo) bool { return info.dir == DirOut }), nil
+	case "less", "greater":
+		v, err := p.number(1 << 20)
+		if err != nil {
+			return nil, err
+		}
+		if tok == "less" {
+			return funcNode(func(info *packetInfo) bool { return info.length <= v }), nil
+		}
+		return funcNode(func(info *packetInfo) bool { return info.length >= v }), nil
+	case "src", "dst":
+		qual := qualSrc
+		if tok == "dst" {
+			qual = qualDst
+		}
+		return p.parseQualified(qual)
+	}
+	p.pos--
+	return p.parseQualified(qualAny)
+}
+
+func (p *parser) parseQualified(qual int) (node, error) {
+	tok := p.next()
+	switch tok {
+	case "host":
+		return p.parseHost(qual)
+	case "net":
+		s := p.next()
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", s)
+		}
+		prefix = prefix.Masked()
+		return funcNode(func(info *packetInfo) bool { return matchAddr(qual, info, prefix.Contains) }), nil
+	case "port":
+		v, err := p.number(65535)
+		if err != nil {
+			return nil, err
+		}
+		return funcNode(func(info *packetInfo) bool { return matchPort(qual, info, uint16(v), uint16(v)) }), nil
+	case "portrange":
+		s := p.next()
+		l, h, ok := strings.Cut(s, "-")
+		lo, err1 := strconv.ParseUint(l, 10, 16)
+		hi, err2 := strconv.ParseUint(h, 10, 16)
+		if !ok || err1 != nil || err2 != nil || lo > hi {
+			return nil, fmt.Errorf("invalid portrange %q", s)
+		}
+		return funcNode(func(info *packetInfo) bool { return matchPort(qual, info, uint16(lo), uint16(hi)) }), nil
+	}
+	if qual != qualAny && tok != "" {
+		p.pos--
+		return p.parseHost(qual)
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+func (p *parser) parseHost(qual int) (node, error) {
+	s := p.next()
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %q", s)
+	}
+	addr = addr.Unmap()
+	return funcNode(func(info *packetInfo) bool {
+		return matchAddr(qual, info, func(a netip.Addr) bool { return a == addr })
+	}), nil
+}
+
+func (p *parser) number(max int) (int, error) {
+	s := p.next()
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > max {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,140 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipPacket an ip packet of the family of src with a transport header carrying
+// the ports, padded to size
+func ipPacket(proto uint8, src, dst string, sport, dport uint16, size int) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	var b []byte
+	if s.Is4() {
+		b = make([]byte, 20)
+		b[0] = 0x45
+		b[8] = 64
+		b[9] = proto
+		copy(b[12:16], s.AsSlice())
+		copy(b[16:20], d.AsSlice())
+	} else {
+		b = make([]byte, 40)
+		b[0] = 0x60
+		b[6] = proto
+		b[7] = 64
+		copy(b[8:24], s.AsSlice())
+		copy(b[24:40], d.AsSlice())
+	}
+	b = binary.BigEndian.AppendUint16(b, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = append(b, make([]byte, max(size-len(b), 4))...)
+	if s.Is4() {
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	} else {
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-40))
+	}
+	return b
+}
+
+func TestFilter(t *testing.T) {
+	var (
+		tcp80   = ipPacket(protoTCP, "10.0.0.1", "10.0.1.2", 40000, 80, 60)
+		udp53   = ipPacket(protoUDP, "10.0.0.1", "192.168.1.1", 5353, 53, 40)
+		udp80   = ipPacket(protoUDP, "10.0.0.1", "192.168.1.1", 5353, 80, 40)
+		icmp    = ipPacket(protoICMP, "10.0.1.2", "10.0.0.1", 0, 0, 30)
+		tcp6    = ipPacket(protoTCP, "fd00::1", "fd00::2", 1500, 443, 80)
+		garbage = []byte{0xff, 1, 2}
+	)
+	for _, tc := range []struct {
+		expr string
+		dir  Direction
+		pkt  []byte
+		want bool
+	}{
+		{"", DirIn, garbage, true},
+		{"ip", DirIn, tcp80, true},
+		{"ip", DirIn, tcp6, false},
+		{"ip6", DirIn, tcp6, true},
+		{"tcp", DirIn, tcp6, true},
+		{"TCP", DirIn, tcp80, true},
+		{"udp", DirIn, tcp80, false},
+		{"icmp", DirIn, icmp, true},
+		{"proto 17", DirIn, udp53, true},
+		{"tcp", DirIn, garbage, false},
+		{"host 10.0.0.1", DirIn, icmp, true},
+		{"src host 10.0.0.1", DirIn, icmp, false},
+		{"dst host 10.0.0.1", DirIn, icmp, true},
+		{"src 10.0.0.1", DirIn, tcp80, true},
+		{"host ::ffff:10.0.0.1", DirIn, tcp80, true},
+		{"net 10.0.1.0/24", DirIn, tcp80, true},
+		{"src net 10.0.1.0/24", DirIn, tcp80, false},
+		{"dst net 192.168.0.0/16", DirIn, udp53, true},
+		{"net fd00::/64", DirIn, tcp6, true},
+		{"port 80", DirIn, tcp80, true},
+		{"src port 80", DirIn, tcp80, false},
+		{"dst port 443", DirIn, tcp6, true},
+		{"port 80", DirIn, icmp, false},
+		{"portrange 1000-2000", DirIn, tcp6, true},
+		{"dst portrange 1000-2000", DirIn, tcp6, false},
+		{"tcp dst port 80", DirIn, tcp80, true},
+		{"tcp dst port 80", DirIn, udp80, false},
+		{"in", DirIn, tcp80, true},
+		{"out", DirIn, tcp80, false},
+		{"outbound", DirOut, tcp80, true},
+		{"less 40", DirIn, udp53, true},
+		{"less 39", DirIn, udp53, false},
+		{"greater 60", DirIn, tcp80, true},
+
+		// not binds tighter than and, and tighter than or
+		{"udp or tcp and port 80", DirIn, udp53, true},
+		{"(udp or tcp) and port 80", DirIn, udp53, false},
+		{"not tcp and udp", DirIn, udp53, true},
+		{"not (tcp or udp)", DirIn, udp53, false},
+		{"! tcp && port 80", DirIn, udp80, true},
+		{"tcp && port 443 || icmp", DirIn, icmp, true},
+		{"!udp", DirIn, udp53, false},
+		{"not not udp", DirIn, udp53, true},
+		{"in and (dst port 53 or dst port 80)", DirIn, udp80, true},
+		{"in and (dst port 53 or dst port 80)", DirOut, udp80, false},
+	} {
+		f, err := CompileFilter(tc.expr)
+		if err != nil {
+			t.Fatalf("compile %q: %v", tc.expr, err)
+		}
+		if got := f.Match(tc.dir, tc.pkt); got != tc.want {
+			t.Errorf("%q on % x (%s): %v, want %v", tc.expr, tc.pkt[:min(len(tc.pkt), 24)], tc.dir, got, tc.want)
+		}
+	}
+
+	var nilFilter *Filter
+	if !nilFilter.Match(DirIn, tcp80) {
+		t.Error("nil filter does not match")
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"or tcp",
+		"not",
+		"bogus",
+		"host",
+		"host example.com",
+		"net 10.0.0.0",
+		"port 70000",
+		"port http",
+		"portrange 20-10",
+		"portrange 20",
+		"proto 256",
+		"less x",
+		"tcp port",
+		"src",
+	} {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("%q compiled", expr)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	blockTypeSHB = 0x0A0D0D0A
+	blockTypeIDB = 0x00000001
+	blockTypeEPB = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	// LinkTypeRaw raw IPv4/IPv6 packets without link layer header
+	LinkTypeRaw = 101
+
+	optEndOfOpt  = 0
+	optIfName    = 2
+	optIfTsresol = 9
+	optEpbFlags  = 2
+)
+
+// Direction of a captured packet, the values match pcapng epb_flags
+type Direction uint8
+
+const (
+	// DirIn packet read from the nic
+	DirIn Direction = 1
+	// DirOut packet written to the nic
+	DirOut Direction = 2
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirIn:
+		return "in"
+	case DirOut:
+		return "out"
+	}
+	return "unknown"
+}
+
+// Writer writes raw ip packets in pcapng format
+type Writer struct {
+	w       io.Writer
+	ifName  string
+	snaplen int
+
+	headerWritten bool
+	buf           []byte
+	written       int64
+}
+
+// NewWriter create a pcapng writer. snaplen <= 0 means no limit
+func NewWriter(w io.Writer, ifName string, snaplen int) *Writer {
+	if snaplen <= 0 {
+		snaplen = 65535
+	}
+	return &Writer{w: w, ifName: ifName, snaplen: snaplen}
+}
+
+// Written bytes written to the underlying writer
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+func (w *Writer) writeHeader() error {
+	w.buf = w.buf[:0]
+	// section header block
+	w.buf = le32(w.buf, blockTypeSHB)
+	w.buf = le32(w.buf, 28)
+	w.buf = le32(w.buf, byteOrderMagic)
+	w.buf = le16(w.buf, 1)
+	w.buf = le16(w.buf, 0)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, ^uint64(0))
+	w.buf = le32(w.buf, 28)
+
+	// interface description block
+	start := len(w.buf)
+	w.buf = le32(w.buf, blockTypeIDB)
+	w.buf = le32(w.buf, 0) // fill later
+	w.buf = le16(w.buf, LinkTypeRaw)
+	w.buf = le16(w.buf, 0)
+	w.buf = le32(w.buf, uint32(w.snaplen))
+	if w.ifName != "" {
+		w.buf = appendOption(w.buf, optIfName, []byte(w.ifName))
+	}
+	w.buf = appendOption(w.buf, optIfTsresol, []byte{9}) // nanoseconds
+	w.buf = le32(w.buf, optEndOfOpt)
+	w.buf = le32(w.buf, uint32(len(w.buf)-start+4))
+	binary.LittleEndian.PutUint32(w.buf[start+4:], uint32(len(w.buf)-start))
+	return w.flush()
+}
+
+// WritePacket write an enhanced packet block
+func (w *Writer) WritePacket(ts time.Time, dir Direction, data []byte) error {
+	if !w.headerWritten {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+		w.headerWritten = true
+	}
+	origLen := len(data)
+	if len(data) > w.snaplen {
+		data = data[:w.snaplen]
+	}
+	nanos := uint64(ts.UnixNano())
+
+	w.buf = w.buf[:0]
+	w.buf = le32(w.buf, blockTypeEPB)
+	w.buf = le32(w.buf, 0) // fill later
+	w.buf = le32(w.buf, 0) // interface id
+	w.buf = le32(w.buf, uint32(nanos>>32))
+	w.buf = le32(w.buf, uint32(nanos))
+	w.buf = le32(w.buf, uint32(len(data)))
+	w.buf = le32(w.buf, uint32(origLen))
+	w.buf = append(w.buf, data...)
+	w.buf = append(w.buf, make([]byte, pad4(len(data)))...)
+	if dir != 0 {
+		w.buf = appendOption(w.buf, optEpbFlags, le32(nil, uint32(dir)))
+		w.buf = le32(w.buf, optEndOfOpt)
+	}
+	w.buf = le32(w.buf, uint32(len(w.buf)+4))
+	binary.LittleEndian.PutUint32(w.buf[4:], uint32(len(w.buf)))
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	n, err := w.w.Write(w.buf)
+	w.written += int64(n)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = le16(b, code)
+	b = le16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func le16(b []byte, v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(b, v)
+}
+
+func le32(b []byte, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
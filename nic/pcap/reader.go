@@ -0,0 +1,295 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	blockTypeSPB = 0x00000003
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLoop     = 108
+	linkTypeSLL      = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+)
+
+var errUnsupportedLinkType = errors.New("unsupported link type")
+
+// Reader reads ip packets from a pcap or pcapng stream. link layer headers of
+// ethernet, loopback and linux cooked captures are stripped
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// pcap
+	linkType uint32
+	nanos    bool
+
+	// pcapng
+	ifaces []ngInterface
+	buf    []byte
+
+	snaplen int
+}
+
+type ngInterface struct {
+	linkType uint16
+	tsPerSec uint64  // timestamp units per second of a decimal resolution
+	tsUnit   float64 // seconds per timestamp unit otherwise
+}
+
+func (iface ngInterface) time(ts uint64) time.Time {
+	if iface.tsPerSec == 0 {
+		sec, frac := math.Modf(float64(ts) * iface.tsUnit)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+	sec, rem := ts/iface.tsPerSec, ts%iface.tsPerSec
+	if iface.tsPerSec <= 1e9 {
+		return time.Unix(int64(sec), int64(rem*(1e9/iface.tsPerSec)))
+	}
+	return time.Unix(int64(sec), int64(rem/(iface.tsPerSec/1e9)))
+}
+
+// NewReader detect the file format and read the file header
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read capture header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == blockTypeSHB {
+		pr.ng = true
+		return pr, nil
+	}
+	var hdr [24]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[:4]) {
+		case pcapMagicMicro:
+			pr.order = order
+		case pcapMagicNano:
+			pr.order, pr.nanos = order, true
+		default:
+			continue
+		}
+		pr.linkType = order.Uint32(hdr[20:24]) & 0x0fffffff
+		pr.snaplen = int(order.Uint32(hdr[16:20]))
+		return pr, nil
+	}
+	return nil, fmt.Errorf("unknown capture file magic %x", hdr[:4])
+}
+
+// ReadPacket read the next ip packet. dir is 0 when the capture has no
+// direction information. data is valid until the next call
+func (r *Reader) ReadPacket() (ts time.Time, dir Direction, data []byte, err error) {
+	for {
+		if r.ng {
+			ts, dir, data, err = r.readBlock()
+		} else {
+			ts, data, err = r.readRecord()
+		}
+		if err != nil || len(data) > 0 {
+			return
+		}
+	}
+}
+
+// Snaplen the max bytes captured per packet, 0 when unlimited or unknown. a
+// pcapng capture knows it after the first packet is read
+func (r *Reader) Snaplen() int {
+	return r.snaplen
+}
+
+func (r *Reader) readRecord() (time.Time, []byte, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+	sec := int64(r.order.Uint32(hdr[0:4]))
+	frac := int64(r.order.Uint32(hdr[4:8]))
+	if !r.nanos {
+		frac *= 1000
+	}
+	capLen := r.order.Uint32(hdr[8:12])
+	if capLen > 1<<18 {
+		return time.Time{}, nil, fmt.Errorf("invalid pcap record length %d", capLen)
+	}
+	r.buf = grow(r.buf, int(capLen))
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return time.Time{}, nil, err
+	}
+	data, err := stripLinkLayer(r.linkType, r.buf)
+	if err != nil {
+		return time.Time{}, nil, nil // skip non ip frames
+	}
+	return time.Unix(sec, frac), data, nil
+}
+
+func (r *Reader) readBlock() (time.Time, Direction, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return time.Time{}, 0, nil, err
+	}
+	blockType := binary.LittleEndian.Uint32(hdr[:4])
+	if blockType == blockTypeSHB {
+		// byte order magic decides how the length is read
+		var bom [4]byte
+		if _, err := io.ReadFull(r.r, bom[:]); err != nil {
+			return time.Time{}, 0, nil, err
+		}
+		r.order = binary.LittleEndian
+		if binary.BigEndian.Uint32(bom[:]) == byteOrderMagic {
+			r.order = binary.BigEndian
+		}
+		r.ifaces = r.ifaces[:0]
+		length := r.order.Uint32(hdr[4:8])
+		if length < 16 || length > 1<<20 {
+			return time.Time{}, 0, nil, fmt.Errorf("invalid pcapng section length %d", length)
+		}
+		_, err := r.r.Discard(int(length) - 12)
+		return time.Time{}, 0, nil, err
+	}
+	blockType = r.order.Uint32(hdr[:4])
+	length := r.order.Uint32(hdr[4:8])
+	if length < 12 || length > 1<<20 || length%4 != 0 {
+		return time.Time{}, 0, nil, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+	r.buf = grow(r.buf, int(length)-8)
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return time.Time{}, 0, nil, err
+	}
+	body := r.buf[:len(r.buf)-4]
+	switch blockType {
+	case blockTypeIDB:
+		if len(body) < 8 {
+			return time.Time{}, 0, nil, fmt.Errorf("short pcapng interface block")
+		}
+		iface := ngInterface{linkType: r.order.Uint16(body[0:2]), tsPerSec: 1e6}
+		r.snaplen = max(r.snaplen, int(r.order.Uint32(body[4:8])))
+		walkOptions(r.order, body[8:], func(code uint16, value []byte) {
+			if code == optIfTsresol && len(value) > 0 {
+				switch {
+				case value[0] <= 18:
+					iface.tsPerSec = uint64(math.Pow10(int(value[0])))
+				case value[0]&0x80 == 0:
+					iface.tsPerSec, iface.tsUnit = 0, math.Pow10(-int(value[0]))
+				default:
+					iface.tsPerSec, iface.tsUnit = 0, math.Pow(2, -float64(value[0]&0x7f))
+				}
+			}
+		})
+		r.ifaces = append(r.ifaces, iface)
+	case blockTypeEPB:
+		if len(body) < 20 {
+			return time.Time{}, 0, nil, fmt.Errorf("short pcapng packet block")
+		}
+		id := r.order.Uint32(body[0:4])
+		if int(id) >= len(r.ifaces) {
+			return time.Time{}, 0, nil, fmt.Errorf("pcapng packet of unknown interface %d", id)
+		}
+		iface := r.ifaces[id]
+		ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+		capLen := int(r.order.Uint32(body[12:16]))
+		if 20+capLen > len(body) {
+			return time.Time{}, 0, nil, fmt.Errorf("invalid pcapng packet length %d", capLen)
+		}
+		var dir Direction
+		walkOptions(r.order, body[min(20+capLen+pad4(capLen), len(body)):], func(code uint16, value []byte) {
+			if code == optEpbFlags && len(value) == 4 {
+				dir = Direction(r.order.Uint32(value) & 0x3)
+			}
+		})
+		data, err := stripLinkLayer(uint32(iface.linkType), body[20:20+capLen])
+		if err != nil {
+			return time.Time{}, 0, nil, nil
+		}
+		return iface.time(ts), dir, data, nil
+	case blockTypeSPB:
+		if len(r.ifaces) == 0 || len(body) < 4 {
+			return time.Time{}, 0, nil, fmt.Errorf("invalid pcapng simple packet block")
+		}
+		origLen := int(r.order.Uint32(body[0:4]))
+		data, err := stripLinkLayer(uint32(r.ifaces[0].linkType), body[4:4+min(origLen, len(body)-4)])
+		if err != nil {
+			return time.Time{}, 0, nil, nil
+		}
+		return time.Time{}, 0, data, nil
+	}
+	return time.Time{}, 0, nil, nil
+}
+
+func walkOptions(order binary.ByteOrder, b []byte, f func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code, l := order.Uint16(b[0:2]), int(order.Uint16(b[2:4]))
+		if code == optEndOfOpt || 4+l > len(b) {
+			return
+		}
+		f(code, b[4:4+l])
+		b = b[min(4+l+pad4(l), len(b)):]
+	}
+}
+
+func stripLinkLayer(linkType uint32, b []byte) ([]byte, error) {
+	var off int
+	switch linkType {
+	case LinkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeNull, linkTypeLoop:
+		off = 4
+	case linkTypeEthernet:
+		for off = 14; ; off += 4 {
+			if off > len(b) {
+				return nil, errUnsupportedLinkType
+			}
+			etherType := binary.BigEndian.Uint16(b[off-2 : off])
+			if etherType == 0x8100 || etherType == 0x88a8 { // vlan tag
+				continue
+			}
+			if etherType != 0x0800 && etherType != 0x86dd {
+				return nil, errUnsupportedLinkType
+			}
+			break
+		}
+	case linkTypeSLL:
+		off = 16
+	case linkTypeSLL2:
+		off = 20
+	default:
+		return nil, errUnsupportedLinkType
+	}
+	if off >= len(b) {
+		return nil, errUnsupportedLinkType
+	}
+	b = b[off:]
+	if v := b[0] >> 4; v != 4 && v != 6 {
+		return nil, errUnsupportedLinkType
+	}
+	return b, nil
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
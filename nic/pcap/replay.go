@@ -0,0 +1,216 @@
+package pcap
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+var (
+	_ nic.NIC         = (*Replay)(nil)
+	_ nic.DeadlineNIC = (*Replay)(nil)
+)
+
+// Replay is a nic.NIC reading packets from a pcap or pcapng capture and
+// recording every packet written to it. packets captured in the outbound
+// direction are skipped, they are the responses of the original consumer.
+// Read returns io.EOF at the end of the capture
+type Replay struct {
+	r        *Reader
+	closer   io.Closer
+	realtime bool
+
+	readMu       sync.Mutex
+	pool         *nic.PacketPool
+	pending      *nic.Packet // read but not returned yet, due at due
+	due          time.Time
+	first        time.Time
+	start        time.Time
+	readDeadline nic.Deadline
+
+	mu        sync.Mutex
+	written   [][]byte
+	notify    chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplay replay packets from r. realtime honors the original inter-packet
+// timing, otherwise packets are read as fast as possible
+func NewReplay(r io.Reader, realtime bool) (*Replay, error) {
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	rp := &Replay{r: pr, realtime: realtime, notify: make(chan struct{}), closeChan: make(chan struct{})}
+	if c, ok := r.(io.Closer); ok {
+		rp.closer = c
+	}
+	return rp, nil
+}
+
+// OpenReplay replay packets from a capture file
+func OpenReplay(path string, realtime bool) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := NewReplay(f, realtime)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rp, nil
+}
+
+func (rp *Replay) Read() (*nic.Packet, error) {
+	return rp.ReadContext(context.Background())
+}
+
+func (rp *Replay) ReadContext(ctx context.Context) (*nic.Packet, error) {
+	rp.readMu.Lock()
+	defer rp.readMu.Unlock()
+	select {
+	case <-rp.closeChan:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-rp.readDeadline.Done():
+		return nil, os.ErrDeadlineExceeded
+	default:
+	}
+	if rp.pending == nil {
+		if err := rp.next(); err != nil {
+			return nil, err
+		}
+	}
+	if wait := time.Until(rp.due); rp.realtime && wait > 0 {
+		// an interrupted wait keeps the packet for the next read
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rp.readDeadline.Done():
+			return nil, os.ErrDeadlineExceeded
+		case <-rp.closeChan:
+			return nil, net.ErrClosed
+		}
+	}
+	pkt := rp.pending
+	rp.pending = nil
+	return pkt, nil
+}
+
+// next read the next inbound packet into pending and set its due time
+func (rp *Replay) next() error {
+	var ts time.Time
+	var data []byte
+	for {
+		var dir Direction
+		var err error
+		ts, dir, data, err = rp.r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if dir != DirOut {
+			break
+		}
+	}
+	rp.due = time.Time{}
+	if rp.realtime && !ts.IsZero() {
+		if rp.first.IsZero() {
+			rp.first, rp.start = ts, time.Now()
+		}
+		rp.due = rp.start.Add(ts.Sub(rp.first))
+	}
+	if rp.pool == nil {
+		rp.pool = nic.NewPacketPool(replayMTU(rp.r.Snaplen()))
+	}
+	pkt := rp.pool.GetSize(len(data))
+	pkt.Write(data)
+	pkt.Meta().Time = ts
+	rp.pending = pkt
+	return nil
+}
+
+// replayMTU size the first class of the packet pool by the snaplen, 65535 and
+// above mean no limit. the larger classes still fit any packet
+func replayMTU(snaplen int) int {
+	if snaplen <= 0 || snaplen >= 65535 {
+		return 1500
+	}
+	return snaplen
+}
+
+func (rp *Replay) SetReadDeadline(t time.Time) error {
+	rp.readDeadline.Set(t)
+	return nil
+}
+
+func (rp *Replay) ReadDeadline() time.Time {
+	return rp.readDeadline.Time()
+}
+
+// Write record a copy of the packet
+func (rp *Replay) Write(p *nic.Packet) error {
+	select {
+	case <-rp.closeChan:
+		return net.ErrClosed
+	default:
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.written = append(rp.written, append([]byte(nil), p.AsBytes()...))
+	close(rp.notify)
+	rp.notify = make(chan struct{})
+	return nil
+}
+
+// Written get the packets written so far
+func (rp *Replay) Written() [][]byte {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return append([][]byte(nil), rp.written...)
+}
+
+// WaitWritten wait until at least n packets have been written
+func (rp *Replay) WaitWritten(ctx context.Context, n int) ([][]byte, error) {
+	for {
+		rp.mu.Lock()
+		written, notify := rp.written, rp.notify
+		rp.mu.Unlock()
+		if len(written) >= n {
+			return append([][]byte(nil), written...), nil
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rp.closeChan:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+func (rp *Replay) Close() error {
+	rp.closeOnce.Do(func() {
+		close(rp.closeChan)
+		rp.readMu.Lock()
+		defer rp.readMu.Unlock()
+		if rp.pending != nil {
+			rp.pending.Release()
+			rp.pending = nil
+		}
+	})
+	if rp.closer != nil {
+		return rp.closer.Close()
+	}
+	return nil
+}
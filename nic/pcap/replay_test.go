@@ -0,0 +1,119 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+func ipv4Packet(id byte) []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45
+	b[3] = byte(len(b))
+	b[5] = id
+	b[8] = 64
+	b[9] = 17
+	copy(b[12:16], []byte{10, 0, 0, 1})
+	copy(b[16:20], []byte{10, 0, 0, 2})
+	return b
+}
+
+func writeCapture(t *testing.T, start time.Time, gaps ...time.Duration) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, "test0", 0)
+	ts := start
+	for i, gap := range gaps {
+		ts = ts.Add(gap)
+		dir := DirIn
+		if i%2 == 1 {
+			dir = DirOut
+		}
+		if err := w.WritePacket(ts, dir, ipv4Packet(byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	start := time.Unix(1700000000, 123456789)
+	rp, err := NewReplay(writeCapture(t, start, 0, time.Millisecond, 2*time.Millisecond), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rp.ReadContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read with canceled ctx: %v", err)
+	}
+
+	// the outbound packet 1 is skipped
+	for _, want := range []struct {
+		id byte
+		ts time.Time
+	}{{0, start}, {2, start.Add(3 * time.Millisecond)}} {
+		p, err := rp.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.AsBytes(), ipv4Packet(want.id)) {
+			t.Fatalf("packet %d: % x", want.id, p.AsBytes())
+		}
+		if !p.Meta().Time.Equal(want.ts) {
+			t.Fatalf("packet %d time %v, want %v", want.id, p.Meta().Time, want.ts)
+		}
+		p.Release()
+	}
+	if _, err := rp.Read(); err != io.EOF {
+		t.Fatalf("read at end: %v", err)
+	}
+
+	p := nic.IPPacketPool.Get()
+	defer p.Release()
+	p.Write(ipv4Packet(9))
+	if err := rp.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if written := rp.Written(); len(written) != 1 || !bytes.Equal(written[0], ipv4Packet(9)) {
+		t.Fatalf("written %x", written)
+	}
+}
+
+func TestReplayRealtimeInterrupted(t *testing.T) {
+	rp, err := NewReplay(writeCapture(t, time.Unix(1700000000, 0), 0, 0, 200*time.Millisecond), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+
+	p, err := rp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+
+	rp.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := rp.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with deadline: %v", err)
+	}
+	rp.SetReadDeadline(time.Time{})
+
+	// the interrupted packet is kept and still due at its original time
+	p, err = rp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+	if !bytes.Equal(p.AsBytes(), ipv4Packet(2)) {
+		t.Fatalf("read % x after interruption", p.AsBytes())
+	}
+}
@@ -0,0 +1,170 @@
+package pipe
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nic "github.com/darkit/waiter"
+)
+
+var (
+	_ nic.BatchNIC    = (*PipeNIC)(nil)
+	_ nic.DeadlineNIC = (*PipeNIC)(nil)
+)
+
+var ErrPacketTooBig = errors.New("packet too big")
+
+type Config struct {
+	// Name written as the Meta().Ingress of the packets read from either end,
+	// default "pipe"
+	Name string
+	// MTU max ip packet size accepted by Write, 0 means no limit
+	MTU int
+	// QueueSize packets buffered per direction, default 512
+	QueueSize int
+	// DropWhenFull drop packets instead of blocking Write when the queue is full
+	DropWhenFull bool
+}
+
+// PipeNIC is one end of an in-memory link, what one end writes the other reads
+type PipeNIC struct {
+	cfg  Config
+	in   chan *nic.Packet
+	out  chan *nic.Packet
+	link *link
+
+	closed       atomic.Bool
+	dropped      atomic.Uint64
+	readDeadline nic.Deadline
+}
+
+type link struct {
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// New create a connected pair of in-memory NICs
+func New(cfg Config) (*PipeNIC, *PipeNIC) {
+	cfg.QueueSize = cmp.Or(cfg.QueueSize, 512)
+	cfg.Name = cmp.Or(cfg.Name, "pipe")
+	l := &link{closeChan: make(chan struct{})}
+	ab := make(chan *nic.Packet, cfg.QueueSize)
+	ba := make(chan *nic.Packet, cfg.QueueSize)
+	return &PipeNIC{cfg: cfg, in: ba, out: ab, link: l}, &PipeNIC{cfg: cfg, in: ab, out: ba, link: l}
+}
+
+// Read read the packet written by the other end. after the link is closed the
+// packets already queued are still delivered to the end which did not close it
+func (p *PipeNIC) Read() (*nic.Packet, error) {
+	return p.ReadContext(context.Background())
+}
+
+func (p *PipeNIC) ReadContext(ctx context.Context) (*nic.Packet, error) {
+	if p.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	select {
+	case pkt := <-p.in:
+		return pkt, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.readDeadline.Done():
+		return nil, os.ErrDeadlineExceeded
+	case <-p.link.closeChan:
+	}
+	select {
+	case pkt := <-p.in:
+		return pkt, nil
+	default:
+	}
+	return nil, net.ErrClosed
+}
+
+func (p *PipeNIC) SetReadDeadline(t time.Time) error {
+	p.readDeadline.Set(t)
+	return nil
+}
+
+func (p *PipeNIC) ReadDeadline() time.Time {
+	return p.readDeadline.Time()
+}
+
+func (p *PipeNIC) ReadBatch(pkts []*nic.Packet) (int, error) {
+	return nic.FillBatch(pkts, p.Read, func() *nic.Packet {
+		select {
+		case pkt := <-p.in:
+			return pkt
+		default:
+			return nil
+		}
+	})
+}
+
+// Write send a copy-on-write clone of the packet to the other end, the clone
+// gets the metadata of a packet received by the pipe
+func (p *PipeNIC) Write(pkt *nic.Packet) error {
+	b := pkt.AsBytes()
+	if p.cfg.MTU > 0 && len(b) > p.cfg.MTU {
+		return fmt.Errorf("pipe write %d bytes (mtu %d): %w", len(b), p.cfg.MTU, ErrPacketTooBig)
+	}
+	select {
+	case <-p.link.closeChan:
+		return net.ErrClosed
+	default:
+	}
+	cp := pkt.Clone()
+	*cp.Meta() = nic.Metadata{Ingress: p.cfg.Name, Time: time.Now()}
+	if p.cfg.DropWhenFull {
+		select {
+		case p.out <- cp:
+		default:
+			p.dropped.Add(1)
+			cp.Release()
+		}
+		return nil
+	}
+	select {
+	case p.out <- cp:
+		return nil
+	case <-p.link.closeChan:
+		cp.Release()
+		return net.ErrClosed
+	}
+}
+
+func (p *PipeNIC) WriteBatch(pkts []*nic.Packet) (int, error) {
+	for i, pkt := range pkts {
+		if err := p.Write(pkt); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// Dropped packets dropped by Write because the queue was full
+func (p *PipeNIC) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// Close close the link, both ends see net.ErrClosed afterwards
+func (p *PipeNIC) Close() error {
+	p.closed.Store(true)
+	p.link.closeOnce.Do(func() {
+		close(p.link.closeChan)
+	})
+	for {
+		select {
+		case pkt := <-p.in:
+			pkt.Release()
+		default:
+			return nil
+		}
+	}
+}
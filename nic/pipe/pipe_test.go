@@ -0,0 +1,119 @@
+package pipe_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/waiter/nic/gvisor"
+	"github.com/darkit/waiter/nic/pipe"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 100})
+	defer a.Close()
+
+	p := nic.IPPacketPool.Get()
+	p.Write([]byte("hello"))
+	if err := a.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	got, err := b.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.AsBytes()) != "hello" {
+		t.Fatalf("read %q", got.AsBytes())
+	}
+	got.Release()
+
+	big := nic.IPPacketPool.Get()
+	defer big.Release()
+	big.Write(make([]byte, 101))
+	if err := a.Write(big); !errors.Is(err, pipe.ErrPacketTooBig) {
+		t.Fatalf("write over mtu: %v", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with deadline: %v", err)
+	}
+	b.SetReadDeadline(time.Time{})
+
+	b.Close()
+	big.Reset()
+	if err := a.Write(big); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+// TestBridgeGvisor two gVisor stacks bridged over a pipe talk TCP
+func TestBridgeGvisor(t *testing.T) {
+	a, b := pipe.New(pipe.Config{MTU: 1500})
+	g1, err := gvisor.Create(nic.Config{MTU: 1500, IPv4: "10.0.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g1.Close()
+	g2, err := gvisor.Create(nic.Config{MTU: 1500, IPv4: "10.0.0.2/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	br1 := &nic.Bridge{A: g1, B: a}
+	br2 := &nic.Bridge{A: g2, B: b}
+	done := make(chan error, 2)
+	go func() { done <- br1.Run(ctx) }()
+	go func() { done <- br2.Run(ctx) }()
+
+	l, err := g2.Listen("tcp4", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(data)
+		c.Close()
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dialCancel()
+	c, err := g1.DialContextTCPAddrPort(dialCtx, netip.MustParseAddrPort("10.0.0.2:8080"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(c)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data))
+	}
+
+	cancel()
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Fatalf("bridge: %v", err)
+		}
+	}
+	if ab, _ := br1.Stats(); ab.Packets == 0 {
+		t.Fatal("bridge moved no packets")
+	}
+}
@@ -2,27 +2,38 @@ package tun
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	nic "github.com/darkit/waiter"
 	"github.com/darkit/waiter/netlink"
 	"github.com/darkit/wireguard/tun"
 )
 
-var _ nic.NIC = (*TUNIC)(nil)
+var (
+	_ nic.BatchNIC    = (*TUNIC)(nil)
+	_ nic.DeadlineNIC = (*TUNIC)(nil)
+)
 
 // TUNIC implements nic.NIC use os TUN device
 type TUNIC struct {
 	dev    tun.Device
 	mtu    int
 	ifName string
+	pool   *nic.PacketPool
 
 	readBufs  [][]byte
 	readSizes []int
 	readInit  sync.Once
 
 	readTotal, read int
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
 }
 
 func Create(cfg nic.Config) (*TUNIC, error) {
@@ -41,11 +52,73 @@ func Create(cfg nic.Config) (*TUNIC, error) {
 	if cfg.IPv6 != "" {
 		netlink.SetupLink(deviceName, cfg.IPv6)
 	}
-	return &TUNIC{dev: device, ifName: cfg.Name, mtu: cfg.MTU}, nil
+	return &TUNIC{dev: device, ifName: cfg.Name, mtu: cfg.MTU, pool: nic.NewPacketPool(cfg.MTU)}, nil
 }
 
 // Read read ip packet from nic. no concurrency support
 func (tun *TUNIC) Read() (*nic.Packet, error) {
+	var pkts [1]*nic.Packet
+	if _, err := tun.ReadBatch(pkts[:]); err != nil {
+		return nil, err
+	}
+	return pkts[0], nil
+}
+
+// ReadContext read ip packet from nic. no concurrency support.
+// it interrupts the device read with the read deadline of the tun file
+func (tun *TUNIC) ReadContext(ctx context.Context) (*nic.Packet, error) {
+	if ctx.Done() == nil {
+		return tun.Read()
+	}
+	f := tun.dev.File()
+	if f == nil {
+		return nil, errors.ErrUnsupported
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		tun.deadlineMu.Lock()
+		defer tun.deadlineMu.Unlock()
+		f.SetReadDeadline(time.Unix(1, 0))
+	})
+	p, err := tun.Read()
+	if !stop() {
+		// the callback has started, restore after it set the deadline
+		<-interrupted
+		tun.deadlineMu.Lock()
+		f.SetReadDeadline(tun.readDeadline)
+		tun.deadlineMu.Unlock()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ctx.Err()
+		}
+	}
+	return p, err
+}
+
+// SetReadDeadline set the read deadline of the tun file
+func (tun *TUNIC) SetReadDeadline(t time.Time) error {
+	f := tun.dev.File()
+	if f == nil {
+		return errors.ErrUnsupported
+	}
+	tun.deadlineMu.Lock()
+	defer tun.deadlineMu.Unlock()
+	tun.readDeadline = t
+	return f.SetReadDeadline(t)
+}
+
+// ReadDeadline get the read deadline set by SetReadDeadline
+func (tun *TUNIC) ReadDeadline() time.Time {
+	tun.deadlineMu.Lock()
+	defer tun.deadlineMu.Unlock()
+	return tun.readDeadline
+}
+
+// ReadBatch read a batch of ip packets from nic. no concurrency support
+func (tun *TUNIC) ReadBatch(pkts []*nic.Packet) (int, error) {
+	if len(pkts) == 0 {
+		return 0, nil
+	}
 	tun.readInit.Do(func() {
 		tun.readBufs = make([][]byte, tun.dev.BatchSize())
 		tun.readSizes = make([]int, tun.dev.BatchSize())
@@ -53,28 +126,63 @@ func (tun *TUNIC) Read() (*nic.Packet, error) {
 			tun.readBufs[i] = make([]byte, tun.mtu+nic.IPPacketOffset+40)
 		}
 	})
-	if tun.read < tun.readTotal {
-		pkt := nic.IPPacketPool.Get()
-		tun.read++
-		return pkt, pkt.Write(tun.readBufs[tun.read][nic.IPPacketOffset : tun.readSizes[tun.read]+nic.IPPacketOffset])
+	for tun.read >= tun.readTotal {
+		n, err := tun.dev.Read(tun.readBufs, tun.readSizes, nic.IPPacketOffset)
+		if err != nil {
+			return 0, err
+		}
+		tun.readTotal = n
+		tun.read = 0
 	}
-	n, err := tun.dev.Read(tun.readBufs, tun.readSizes, nic.IPPacketOffset)
-	if err != nil {
-		return nil, err
+	now := time.Now()
+	n := 0
+	for ; n < len(pkts) && tun.read < tun.readTotal; n++ {
+		pkt := tun.pool.GetSize(tun.readSizes[tun.read])
+		pkt.Write(tun.readBufs[tun.read][nic.IPPacketOffset : tun.readSizes[tun.read]+nic.IPPacketOffset])
+		pkt.Meta().Ingress = tun.ifName
+		pkt.Meta().Time = now
+		pkts[n] = pkt
+		tun.read++
 	}
-	tun.readTotal = n - 1
-	tun.read = 0
-
-	pkt := nic.IPPacketPool.Get()
-	return pkt, pkt.Write(tun.readBufs[tun.read][nic.IPPacketOffset : tun.readSizes[tun.read]+nic.IPPacketOffset])
+	return n, nil
 }
 
-// Write write ip packet to nic
+// Write write ip packet to nic. the device may rewrite the buffer in place,
+// a buffer shared with clones is copied first
 func (tun *TUNIC) Write(p *nic.Packet) error {
+	p.Unshare()
 	_, err := tun.dev.Write([][]byte{p.Bytes(0)}, nic.IPPacketOffset)
 	return err
 }
 
+// WriteBatch write ip packets to nic in one call. the device reports the
+// bytes written but not which packets failed, on error the count is of the
+// leading packets longer than the bytes missing, they can not have failed
+func (tun *TUNIC) WriteBatch(pkts []*nic.Packet) (int, error) {
+	bufs := make([][]byte, len(pkts))
+	missing := 0
+	for i, p := range pkts {
+		p.Unshare() // the device merges packets in place
+		bufs[i] = p.Bytes(0)
+		missing += len(bufs[i]) - nic.IPPacketOffset
+	}
+	total, err := tun.dev.Write(bufs, nic.IPPacketOffset)
+	if err == nil {
+		return len(pkts), nil
+	}
+	missing -= total
+	n := 0
+	for n < len(bufs)-1 && len(bufs[n])-nic.IPPacketOffset > missing {
+		n++
+	}
+	return n, err
+}
+
+// Pool the packet pool sized for the nic MTU, read packets come from it
+func (tun *TUNIC) Pool() *nic.PacketPool {
+	return tun.pool
+}
+
 func (tun *TUNIC) Close() error {
 	return tun.dev.Close()
 }
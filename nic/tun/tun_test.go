@@ -0,0 +1,104 @@
+package tun
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	nic "github.com/darkit/waiter"
+	"github.com/darkit/wireguard/tun"
+)
+
+// fakeDevice a tun.Device writing like the wireguard one: it reports the
+// bytes written and joins the errors of the packets it failed
+type fakeDevice struct {
+	fail    map[int]bool // packets of the next write that fail
+	written [][]byte
+}
+
+func (d *fakeDevice) File() *os.File { return nil }
+
+func (d *fakeDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func (d *fakeDevice) Write(bufs [][]byte, offset int) (int, error) {
+	var errs error
+	total := 0
+	for i, b := range bufs {
+		if d.fail[i] {
+			errs = errors.Join(errs, syscall.EIO)
+			continue
+		}
+		d.written = append(d.written, append([]byte(nil), b[offset:]...))
+		total += len(b) - offset
+		b[offset] ^= 0xff // like the GRO path, which rewrites headers in place
+	}
+	return total, errs
+}
+
+func (d *fakeDevice) MTU() (int, error)        { return 1500, nil }
+func (d *fakeDevice) Name() (string, error)    { return "fake0", nil }
+func (d *fakeDevice) Events() <-chan tun.Event { return nil }
+func (d *fakeDevice) Close() error             { return nil }
+func (d *fakeDevice) BatchSize() int           { return 8 }
+
+func TestWriteBatch(t *testing.T) {
+	dev := &fakeDevice{}
+	tn := &TUNIC{dev: dev, mtu: 1500, pool: nic.NewPacketPool(1500)}
+	pkts := make([]*nic.Packet, 4)
+	for i := range pkts {
+		pkts[i] = nic.IPPacketPool.Get()
+		defer pkts[i].Release()
+		pkts[i].Write(make([]byte, 100*(len(pkts)-i)))
+	}
+
+	// packets, not bytes, are counted
+	if n, err := tn.WriteBatch(pkts); n != len(pkts) || err != nil {
+		t.Fatalf("write batch: %d, %v", n, err)
+	}
+	if len(dev.written) != len(pkts) {
+		t.Fatalf("device wrote %d packets", len(dev.written))
+	}
+
+	// on error the count never includes a failed packet
+	for _, tc := range []struct {
+		fail map[int]bool
+		n    int
+	}{
+		{map[int]bool{0: true}, 0},
+		{map[int]bool{2: true}, 2},
+		{map[int]bool{3: true}, 3},
+		{map[int]bool{2: true, 3: true}, 1},
+		{map[int]bool{1: true, 3: true}, 0},
+	} {
+		dev.fail = tc.fail
+		n, err := tn.WriteBatch(pkts)
+		if n != tc.n || !errors.Is(err, syscall.EIO) {
+			t.Fatalf("write batch failing %v: %d, %v, want %d", tc.fail, n, err, tc.n)
+		}
+	}
+}
+
+func TestWriteUnshares(t *testing.T) {
+	dev := &fakeDevice{}
+	tn := &TUNIC{dev: dev, mtu: 1500, pool: nic.NewPacketPool(1500)}
+	p := nic.IPPacketPool.Get()
+	defer p.Release()
+	p.Write([]byte{0x45, 1, 2, 3})
+	mirror := p.Clone()
+	defer mirror.Release()
+
+	if err := tn.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	c := mirror.Clone()
+	defer c.Release()
+	if _, err := tn.WriteBatch([]*nic.Packet{c}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mirror.AsBytes(); got[0] != 0x45 {
+		t.Fatalf("clone changed by the device write: % x", got)
+	}
+}
@@ -3,6 +3,7 @@
 package tun
 
 import (
+	"cmp"
 	"os"
 
 	nic "github.com/darkit/waiter"
@@ -20,5 +21,6 @@ func CreateFD(tunFD int, cfg nic.Config) (*TUNIC, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &TUNIC{dev: device, mtu: cfg.MTU}, nil
+	name, _ := device.Name()
+	return &TUNIC{dev: device, ifName: cmp.Or(cfg.Name, name), mtu: cfg.MTU, pool: nic.NewPacketPool(cfg.MTU)}, nil
 }
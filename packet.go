@@ -3,14 +3,45 @@ package waiter
 import (
 	"cmp"
 	"fmt"
+	"net"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var IPPacketPool *PacketPool = &PacketPool{MTU: 1428}
 
+// Packet is an ip packet with header room in front of it.
+//
+// A packet has one owner after Get. Ref adds an owner and Release or
+// PacketPool.Put drops one, the last one returns the packet to its pool.
+// Clone shares the buffer copy-on-write: Write and SetHeader copy a shared
+// buffer first, call Unshare before modifying AsBytes in place.
 type Packet struct {
 	buf    []byte
 	offset int
+	pool   *PacketPool
+
+	refs   atomic.Int32                 // owners besides the first one, -1 once released
+	shared atomic.Pointer[atomic.Int32] // packets sharing buf, nil if not shared
+	meta   Metadata
+}
+
+// Metadata carried with a packet through the pipeline, it is kept by Clone
+// and cleared when the packet returns to the pool
+type Metadata struct {
+	// Ingress name of the NIC the packet was read from
+	Ingress string
+	// Peer the packet came from, set by VirtualNIC.Write
+	Peer net.Addr
+	// Time the packet was received
+	Time time.Time
+	// Mark firewall mark
+	Mark uint32
+	// Priority class, higher is more important
+	Priority uint8
 }
 
 func NewPacket(offset, cap int) *Packet {
@@ -25,6 +56,11 @@ func (p *Packet) AsBytes() []byte {
 	return p.buf[p.offset:]
 }
 
+// Meta get the packet metadata
+func (p *Packet) Meta() *Metadata {
+	return &p.meta
+}
+
 // Ver get ip packet version.
 // return 4 or 6
 func (p *Packet) Ver() uint8 {
@@ -45,6 +81,7 @@ func (p *Packet) Bytes(offset int) []byte {
 
 // Write ip packet bytes
 func (p *Packet) Write(b []byte) error {
+	p.Unshare()
 	p.buf = append(p.buf, b...)
 	return nil
 }
@@ -54,6 +91,7 @@ func (p *Packet) SetHeader(header []byte) error {
 	if len(header) > p.offset {
 		return fmt.Errorf("short packet offset")
 	}
+	p.Unshare()
 	copy(p.buf[:p.offset], header)
 	return nil
 }
@@ -63,28 +101,228 @@ func (p *Packet) Reset() {
 	p.buf = p.buf[:p.offset]
 }
 
+// Ref add an owner to the packet
+func (p *Packet) Ref() *Packet {
+	p.refs.Add(1)
+	return p
+}
+
+// Release drop an owner, the last one returns the packet to its pool
+func (p *Packet) Release() {
+	cmp.Or(p.pool, IPPacketPool).Put(p)
+}
+
+// Clone create a packet sharing the buffer copy-on-write, it has its own owner
+func (p *Packet) Clone() *Packet {
+	shared := p.shared.Load()
+	if shared == nil {
+		shared = new(atomic.Int32)
+		shared.Store(1)
+		if !p.shared.CompareAndSwap(nil, shared) {
+			shared = p.shared.Load()
+		}
+	}
+	shared.Add(1)
+	c := &Packet{buf: p.buf, offset: p.offset, pool: p.pool, meta: p.meta}
+	c.shared.Store(shared)
+	if c.pool != nil {
+		c.pool.gets.Add(1)
+		c.pool.track(c, 3)
+	}
+	return c
+}
+
+// Shared report whether the buffer is shared with clones
+func (p *Packet) Shared() bool {
+	shared := p.shared.Load()
+	return shared != nil && shared.Load() > 1
+}
+
+// Unshare give the packet a private copy of a shared buffer
+func (p *Packet) Unshare() {
+	shared := p.shared.Load()
+	if shared == nil {
+		return
+	}
+	p.shared.Store(nil)
+	if shared.Add(-1) == 0 { // the other packets were released
+		return
+	}
+	buf := make([]byte, len(p.buf), cap(p.buf))
+	copy(buf, p.buf)
+	p.buf = buf
+}
+
+// PacketPool is a pool of packets with size classes. the first class fits MTU,
+// larger classes hold jumbo frames and max size ip packets
 type PacketPool struct {
 	MTU int
+	// Debug records where every outstanding packet was obtained, see Leaks
+	Debug bool
 
-	pool     *sync.Pool
+	classes  []*sizeClass
 	poolInit sync.Once
+
+	gets, puts, allocs atomic.Uint64
+
+	leaksMu sync.Mutex
+	leaks   map[*Packet][]uintptr
+}
+
+type sizeClass struct {
+	size int
+	pool sync.Pool
+}
+
+// PoolStats counters of a PacketPool
+type PoolStats struct {
+	Gets, Puts, Allocs, Outstanding uint64
+}
+
+const (
+	jumboPacketSize = 9000
+	maxPacketSize   = (2 << 15) - 1
+)
+
+// NewPacketPool create a pool for a NIC with mtu, the size classes leave
+// IPPacketOffset bytes of header room
+func NewPacketPool(mtu int) *PacketPool {
+	return &PacketPool{MTU: mtu}
 }
 
 func (pool *PacketPool) init() {
 	pool.poolInit.Do(func() {
-		pool.pool = &sync.Pool{New: func() any {
-			return NewPacket(IPPacketOffset, cmp.Or(pool.MTU, (2<<15)-8-40-IPPacketOffset)+IPPacketOffset)
-		}}
+		sizes := []int{cmp.Or(pool.MTU, (2<<15)-8-40-IPPacketOffset)}
+		for _, size := range []int{jumboPacketSize, maxPacketSize} {
+			if size > sizes[len(sizes)-1] {
+				sizes = append(sizes, size)
+			}
+		}
+		for _, size := range sizes {
+			class := &sizeClass{size: size}
+			class.pool.New = func() any {
+				pool.allocs.Add(1)
+				p := NewPacket(IPPacketOffset, class.size+IPPacketOffset)
+				p.pool = pool
+				return p
+			}
+			pool.classes = append(pool.classes, class)
+		}
+		pool.leaks = make(map[*Packet][]uintptr)
 	})
 }
 
+// Get get a packet which fits MTU
 func (pool *PacketPool) Get() *Packet {
 	pool.init()
-	return pool.pool.Get().(*Packet)
+	return pool.get(pool.classes[0])
 }
 
+// GetSize get a packet which fits an ip packet of size bytes without growing
+func (pool *PacketPool) GetSize(size int) *Packet {
+	pool.init()
+	for _, class := range pool.classes {
+		if size <= class.size {
+			return pool.get(class)
+		}
+	}
+	return pool.get(pool.classes[len(pool.classes)-1])
+}
+
+func (pool *PacketPool) get(class *sizeClass) *Packet {
+	pool.gets.Add(1)
+	p := class.pool.Get().(*Packet)
+	p.refs.Store(0)
+	pool.track(p, 4)
+	return p
+}
+
+func (pool *PacketPool) track(p *Packet, skip int) {
+	if pool.Debug {
+		pc := make([]uintptr, 16)
+		pc = pc[:runtime.Callers(skip, pc)]
+		pool.leaksMu.Lock()
+		pool.leaks[p] = pc
+		pool.leaksMu.Unlock()
+	}
+}
+
+// Put drop an owner of the packet, the last one returns it to the pool it was
+// obtained from. releasing a released packet is ignored, it panics in Debug
+// mode
 func (pool *PacketPool) Put(p *Packet) {
+	switch refs := p.refs.Add(-1); {
+	case refs >= 0:
+		return
+	case refs < -1:
+		p.refs.Add(1)
+		if pool.Debug || p.pool != nil && p.pool.Debug {
+			panic("waiter: packet released more than once")
+		}
+		return
+	}
+	if p.pool != nil && p.pool != pool {
+		p.pool.put(p)
+		return
+	}
+	pool.put(p)
+}
+
+func (pool *PacketPool) put(p *Packet) {
 	pool.init()
+	if p.pool == pool { // the others were never counted by Get
+		pool.puts.Add(1)
+	}
+	if pool.Debug {
+		pool.leaksMu.Lock()
+		delete(pool.leaks, p)
+		pool.leaksMu.Unlock()
+	}
+	p.meta = Metadata{}
+	if shared := p.shared.Swap(nil); shared != nil && shared.Add(-1) > 0 {
+		p.buf = nil // the buffer is still used by clones
+		return
+	}
 	p.Reset()
-	pool.pool.Put(p)
+	size := cap(p.buf) - p.offset
+	for i := len(pool.classes) - 1; i >= 0; i-- {
+		if size >= pool.classes[i].size {
+			p.pool = pool
+			pool.classes[i].pool.Put(p)
+			return
+		}
+	}
+}
+
+// Stats get the pool counters
+func (pool *PacketPool) Stats() PoolStats {
+	gets, puts := pool.gets.Load(), pool.puts.Load()
+	return PoolStats{
+		Gets:        gets,
+		Puts:        puts,
+		Allocs:      pool.allocs.Load(),
+		Outstanding: gets - min(gets, puts),
+	}
+}
+
+// Leaks report the call stacks which obtained the outstanding packets, only
+// available in Debug mode
+func (pool *PacketPool) Leaks() []string {
+	pool.init()
+	pool.leaksMu.Lock()
+	defer pool.leaksMu.Unlock()
+	leaks := make([]string, 0, len(pool.leaks))
+	for _, pc := range pool.leaks {
+		var b strings.Builder
+		frames := runtime.CallersFrames(pc)
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+		leaks = append(leaks, b.String())
+	}
+	return leaks
 }
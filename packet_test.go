@@ -0,0 +1,117 @@
+package waiter_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	nic "github.com/darkit/waiter"
+)
+
+func TestPacketRefs(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	p := pool.Get()
+	p.Write([]byte("abc"))
+	p.Ref()
+	p.Release()
+	if s := pool.Stats(); s.Outstanding != 1 {
+		t.Fatalf("released with an owner left: %+v", s)
+	}
+	p.Release()
+	if s := pool.Stats(); s.Outstanding != 0 || s.Puts != 1 {
+		t.Fatalf("last owner released: %+v", s)
+	}
+
+	// a released packet comes back empty
+	p = pool.Get()
+	defer p.Release()
+	if len(p.AsBytes()) != 0 || p.Meta().Ingress != "" {
+		t.Fatalf("packet from the pool with % x, %+v", p.AsBytes(), *p.Meta())
+	}
+}
+
+func TestPacketDoubleRelease(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	p := pool.Get()
+	p.Release()
+	p.Release() // ignored
+	if s := pool.Stats(); s.Puts != 1 {
+		t.Fatalf("double release counted: %+v", s)
+	}
+
+	pool.Debug = true
+	p = pool.Get()
+	p.Release()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("double release in debug mode did not panic")
+		}
+	}()
+	p.Release()
+}
+
+func TestPacketClone(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	p := pool.Get()
+	p.Write([]byte("abc"))
+	p.Meta().Ingress = "eth0"
+	c := p.Clone()
+	if !p.Shared() || !c.Shared() {
+		t.Fatal("clone does not share the buffer")
+	}
+	if c.Meta().Ingress != "eth0" {
+		t.Fatalf("clone metadata %+v", *c.Meta())
+	}
+
+	// writes copy the shared buffer
+	c.Write([]byte("d"))
+	if string(p.AsBytes()) != "abc" || string(c.AsBytes()) != "abcd" {
+		t.Fatalf("write to a clone: %q, %q", p.AsBytes(), c.AsBytes())
+	}
+	if err := p.SetHeader([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// in place changes after Unshare
+	m := p.Clone()
+	p.Unshare()
+	p.AsBytes()[0] = 'x'
+	if string(m.AsBytes()) != "abc" {
+		t.Fatalf("clone changed in place: %q", m.AsBytes())
+	}
+	if p.Shared() {
+		t.Fatal("unshared packet still shared")
+	}
+
+	// the buffer goes back to the pool with its last user
+	p.Release()
+	if !bytes.Equal(m.AsBytes(), []byte("abc")) {
+		t.Fatalf("clone after releasing the original: %q", m.AsBytes())
+	}
+	m.Release()
+	c.Release()
+	if s := pool.Stats(); s.Outstanding != 0 {
+		t.Fatalf("clones outstanding: %+v", s)
+	}
+}
+
+func TestPacketLeaks(t *testing.T) {
+	pool := nic.NewPacketPool(1500)
+	pool.Debug = true
+	p := pool.Get()
+	c := p.Clone()
+	leaks := pool.Leaks()
+	if len(leaks) != 2 {
+		t.Fatalf("%d leaks, want 2", len(leaks))
+	}
+	for _, leak := range leaks {
+		if !strings.Contains(leak, "TestPacketLeaks") {
+			t.Fatalf("leak without its caller:\n%s", leak)
+		}
+	}
+	p.Release()
+	c.Release()
+	if leaks := pool.Leaks(); len(leaks) != 0 {
+		t.Fatalf("leaks after release:\n%s", strings.Join(leaks, "\n"))
+	}
+}
@@ -3,6 +3,7 @@ package waiter
 import (
 	"io"
 	"net"
+	"net/netip"
 	"net/url"
 	"sort"
 	"strings"
@@ -23,25 +24,104 @@ type Config struct {
 	IPv4, IPv6 string
 }
 
+// NIC reads and writes ip packets.
+//
+// The packet returned by Read is owned by the caller, who must return it to
+// the pool exactly once. Write does not take the ownership of p.
 type NIC interface {
 	io.Closer
 	Write(*Packet) error
 	Read() (*Packet, error)
 }
 
+// BatchNIC is implemented by NICs able to move several packets per call
+type BatchNIC interface {
+	NIC
+	// ReadBatch read at least one and up to len(pkts) packets into pkts and
+	// return the number read. the packets are owned by the caller
+	ReadBatch(pkts []*Packet) (int, error)
+	// WriteBatch write pkts and return the number written. it does not take
+	// the ownership of pkts
+	WriteBatch(pkts []*Packet) (int, error)
+}
+
+// ReadBatch read packets from n, one at a time if n is not a BatchNIC
+func ReadBatch(n NIC, pkts []*Packet) (int, error) {
+	if len(pkts) == 0 {
+		return 0, nil
+	}
+	if bn, ok := n.(BatchNIC); ok {
+		return bn.ReadBatch(pkts)
+	}
+	p, err := n.Read()
+	if err != nil {
+		return 0, err
+	}
+	pkts[0] = p
+	return 1, nil
+}
+
+// FillBatch implement ReadBatch of a queue: block on read until one packet is
+// available, then take the queued ones from poll without blocking. poll
+// returns nil when the queue is empty
+func FillBatch(pkts []*Packet, read func() (*Packet, error), poll func() *Packet) (int, error) {
+	if len(pkts) == 0 {
+		return 0, nil
+	}
+	p, err := read()
+	if err != nil {
+		return 0, err
+	}
+	pkts[0] = p
+	n := 1
+	for ; n < len(pkts); n++ {
+		if pkts[n] = poll(); pkts[n] == nil {
+			break
+		}
+	}
+	return n, nil
+}
+
+// WriteBatch write packets to n, one at a time if n is not a BatchNIC
+func WriteBatch(n NIC, pkts []*Packet) (int, error) {
+	if bn, ok := n.(BatchNIC); ok {
+		return bn.WriteBatch(pkts)
+	}
+	for i, p := range pkts {
+		if err := n.Write(p); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
 type Peer struct {
 	Addr       net.Addr
 	IPv4, IPv6 string
 	Meta       url.Values
 }
 
+// PeerEvent a peer added to or removed from a VirtualNIC
+type PeerEvent struct {
+	Peer    Peer
+	Removed bool
+}
+
 type VirtualNIC struct {
 	NIC
+	// FakeIP when set, the traffic to its addresses follows the domain routes
+	// of the mapped domains
+	FakeIP *FakeIPPool
 
 	routing    *cache[string, string] // cidr as key, via ip as value
+	domains    *cache[string, string] // domain suffix as key, via ip as value
 	peers      *cache[string, *Peer]  // ip as key
 	nicInit    sync.Once
 	peersMutex sync.RWMutex
+
+	watchers     map[int]func(PeerEvent)
+	watcherID    int
+	watchersLock sync.Mutex
 }
 
 func (r *VirtualNIC) init() {
@@ -50,6 +130,7 @@ func (r *VirtualNIC) init() {
 	}
 	r.nicInit.Do(func() {
 		r.routing = New[string, string](512)
+		r.domains = New[string, string](512)
 		r.peers = New[string, *Peer](1024)
 	})
 }
@@ -62,6 +143,15 @@ func (r *VirtualNIC) GetPeer(ip string) (net.Addr, bool) {
 	if ok {
 		return peerID.Addr, true
 	}
+	if r.FakeIP != nil {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			if domain, ok := r.FakeIP.Domain(addr); ok {
+				if peerID, ok := r.routeDomain(domain); ok {
+					return peerID.Addr, true
+				}
+			}
+		}
+	}
 	dstIP := net.ParseIP(ip)
 	_, v, _ := r.routing.Find(func(k string, v string) bool {
 		_, cidr, err := net.ParseCIDR(k)
@@ -77,22 +167,46 @@ func (r *VirtualNIC) GetPeer(ip string) (net.Addr, bool) {
 	return peerID.Addr, true
 }
 
+// Write write a packet sent by a peer, Meta().Peer is set to the peer its
+// source address routes to when it is not set yet
+func (r *VirtualNIC) Write(p *Packet) error {
+	if p.Meta().Peer == nil {
+		if src, ok := packetSource(p.AsBytes()); ok {
+			if addr, ok := r.GetPeer(src.String()); ok {
+				p.Meta().Peer = addr
+			}
+		}
+	}
+	return r.NIC.Write(p)
+}
+
+// packetSource the source address of an ip packet
+func packetSource(b []byte) (netip.Addr, bool) {
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case len(b) >= 40 && b[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(b[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
 func (r *VirtualNIC) AddPeer(peer Peer) {
 	r.init()
 	r.peersMutex.Lock()
-	defer r.peersMutex.Unlock()
 	if peer.IPv4 != "" {
 		r.peers.Put(peer.IPv4, &peer)
 	}
 	if peer.IPv6 != "" {
 		r.peers.Put(peer.IPv6, &peer)
 	}
+	r.peersMutex.Unlock()
+	r.notifyPeers(PeerEvent{Peer: peer})
 }
 
 func (r *VirtualNIC) RemovePeer(addr net.Addr) {
 	r.init()
 	r.peersMutex.Lock()
-	defer r.peersMutex.Unlock()
 	_, v, ok := r.peers.Find(func(s string, p *Peer) bool {
 		return p.Addr == addr
 	})
@@ -100,6 +214,40 @@ func (r *VirtualNIC) RemovePeer(addr net.Addr) {
 		r.peers.Del(v.IPv4)
 		r.peers.Del(v.IPv6)
 	}
+	r.peersMutex.Unlock()
+	if ok {
+		r.notifyPeers(PeerEvent{Peer: *v, Removed: true})
+	}
+}
+
+// WatchPeers call fn after every AddPeer and RemovePeer until cancel is
+// called. fn runs on the goroutine changing the peers and must not block
+func (r *VirtualNIC) WatchPeers(fn func(PeerEvent)) (cancel func()) {
+	r.watchersLock.Lock()
+	defer r.watchersLock.Unlock()
+	if r.watchers == nil {
+		r.watchers = make(map[int]func(PeerEvent))
+	}
+	id := r.watcherID
+	r.watcherID++
+	r.watchers[id] = fn
+	return func() {
+		r.watchersLock.Lock()
+		defer r.watchersLock.Unlock()
+		delete(r.watchers, id)
+	}
+}
+
+func (r *VirtualNIC) notifyPeers(e PeerEvent) {
+	r.watchersLock.Lock()
+	watchers := make([]func(PeerEvent), 0, len(r.watchers))
+	for _, fn := range r.watchers {
+		watchers = append(watchers, fn)
+	}
+	r.watchersLock.Unlock()
+	for _, fn := range watchers {
+		fn(e)
+	}
 }
 
 func (r *VirtualNIC) AddRoute(dst *net.IPNet, via net.IP) bool {
@@ -137,3 +285,72 @@ func (r *VirtualNIC) Peers() []*Peer {
 	})
 	return peers
 }
+
+// AddDomainRoute route domain and its subdomains via a peer, "*.example.com"
+// is the same as "example.com". the longest matching domain wins
+func (r *VirtualNIC) AddDomainRoute(domain string, via net.IP) bool {
+	r.init()
+	domain = normalizeDomain(strings.TrimPrefix(domain, "*."))
+	if domain == "" {
+		return false
+	}
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	slog.Info("AddDomainRoute", "domain", domain, "via", via)
+	r.domains.Put(domain, via.String())
+	return true
+}
+
+func (r *VirtualNIC) DelDomainRoute(domain string, via net.IP) bool {
+	r.init()
+	domain = normalizeDomain(strings.TrimPrefix(domain, "*."))
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	slog.Info("DelDomainRoute", "domain", domain, "via", via)
+	if v, ok := r.domains.Get(domain); !ok || v != via.String() {
+		return false
+	}
+	r.domains.Del(domain)
+	return true
+}
+
+// MatchDomain whether a domain route covers domain, e.g. as the Match of the
+// FakeIP pool
+func (r *VirtualNIC) MatchDomain(domain string) bool {
+	r.init()
+	r.peersMutex.RLock()
+	defer r.peersMutex.RUnlock()
+	_, ok := r.matchDomain(normalizeDomain(domain))
+	return ok
+}
+
+// RouteDomain the peer the traffic to domain is routed via
+func (r *VirtualNIC) RouteDomain(domain string) (net.Addr, bool) {
+	r.init()
+	r.peersMutex.RLock()
+	defer r.peersMutex.RUnlock()
+	peerID, ok := r.routeDomain(normalizeDomain(domain))
+	if !ok {
+		return nil, false
+	}
+	return peerID.Addr, true
+}
+
+func (r *VirtualNIC) routeDomain(domain string) (*Peer, bool) {
+	via, ok := r.matchDomain(domain)
+	if !ok {
+		return nil, false
+	}
+	return r.peers.Get(via)
+}
+
+// matchDomain the via ip of the longest domain route matching domain
+func (r *VirtualNIC) matchDomain(domain string) (string, bool) {
+	for domain != "" {
+		if via, ok := r.domains.Get(domain); ok {
+			return via, true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return "", false
+}